@@ -0,0 +1,172 @@
+package flexmgo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/eaciit/toolkit"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	AuthScramSha1   = "SCRAM-SHA-1"
+	AuthScramSha256 = "SCRAM-SHA-256"
+	AuthX509        = "MONGODB-X509"
+	AuthPlain       = "PLAIN"
+	AuthGSSAPI      = "GSSAPI"
+)
+
+// authMechanisms maps the accepted authMechanism values, lower cased, to the
+// mechanism name sent to the driver. ldap and x509 are short aliases.
+var authMechanisms = map[string]string{
+	"scram-sha-1":   AuthScramSha1,
+	"scram-sha-256": AuthScramSha256,
+	"mongodb-x509":  AuthX509,
+	"x509":          AuthX509,
+	"plain":         AuthPlain,
+	"ldap":          AuthPlain,
+	"gssapi":        AuthGSSAPI,
+}
+
+// authCredential validates the authSource, authMechanism and
+// authMechanismProperties config of the connection and returns the credential
+// to authenticate with. It returns nil when no authentication is required.
+func (c *Connection) authCredential() (*options.Credential, error) {
+	source := c.configString("authSource")
+	mechName := c.configString("authMechanism")
+	props, err := configPairs(c.configValue("authMechanismProperties"))
+	if err != nil {
+		return nil, toolkit.Errorf("invalid authMechanismProperties. %s", err.Error())
+	}
+
+	mech := ""
+	if mechName != "" {
+		var ok bool
+		if mech, ok = authMechanisms[strings.ToLower(mechName)]; !ok {
+			return nil, toolkit.Errorf("authMechanism %s is not supported", mechName)
+		}
+	}
+
+	if mech == "" && c.User == "" {
+		if source != "" || len(props) > 0 {
+			return nil, toolkit.Errorf("authSource and authMechanismProperties require a user")
+		}
+		return nil, nil
+	}
+
+	cred := &options.Credential{
+		AuthMechanism: mech,
+		AuthSource:    source,
+		Username:      c.User,
+		Password:      c.Password,
+		PasswordSet:   c.Password != "",
+	}
+
+	switch mech {
+	case "", AuthScramSha1, AuthScramSha256:
+		if c.User == "" || c.Password == "" {
+			return nil, toolkit.Errorf("authMechanism %s requires user and password", mechOrDefault(mech))
+		}
+		if cred.AuthSource == "" {
+			cred.AuthSource = "admin"
+		}
+
+	case AuthX509:
+		if c.Password != "" {
+			return nil, toolkit.Errorf("authMechanism %s does not accept a password", mech)
+		}
+
+	case AuthPlain:
+		if c.User == "" || c.Password == "" {
+			return nil, toolkit.Errorf("authMechanism %s requires user and password", mech)
+		}
+
+	case AuthGSSAPI:
+		if c.User == "" {
+			return nil, toolkit.Errorf("authMechanism %s requires a user", mech)
+		}
+	}
+
+	switch mech {
+	case AuthX509, AuthPlain, AuthGSSAPI:
+		if cred.AuthSource == "" {
+			cred.AuthSource = "$external"
+		} else if cred.AuthSource != "$external" {
+			return nil, toolkit.Errorf("authMechanism %s requires authSource $external, got %s", mech, cred.AuthSource)
+		}
+	}
+
+	if len(props) > 0 {
+		if mech != AuthGSSAPI {
+			return nil, toolkit.Errorf("authMechanismProperties is not supported by authMechanism %s", mechOrDefault(mech))
+		}
+		cred.AuthMechanismProperties = props
+	}
+
+	return cred, nil
+}
+
+// authURIValues returns the auth options of cred as connection string values
+func authURIValues(cred *options.Credential) map[string]string {
+	values := map[string]string{"authSource": cred.AuthSource}
+	if cred.AuthMechanism != "" {
+		values["authMechanism"] = cred.AuthMechanism
+	}
+	if len(cred.AuthMechanismProperties) > 0 {
+		keys := []string{}
+		for k := range cred.AuthMechanismProperties {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		pairs := []string{}
+		for _, k := range keys {
+			pairs = append(pairs, k+":"+cred.AuthMechanismProperties[k])
+		}
+		values["authMechanismProperties"] = strings.Join(pairs, ",")
+	}
+	return values
+}
+
+// configPairs reads a value given either as a "KEY:value,KEY2:value2" string
+// or as a map
+func configPairs(v interface{}) (map[string]string, error) {
+	props := map[string]string{}
+	switch x := v.(type) {
+	case nil:
+
+	case string:
+		if strings.TrimSpace(x) == "" {
+			break
+		}
+		for _, pair := range strings.Split(x, ",") {
+			kv := strings.SplitN(pair, ":", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				return nil, toolkit.Errorf("%s is not a list of KEY:value pairs", x)
+			}
+			props[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+
+	case map[string]string:
+		for k, pv := range x {
+			props[k] = pv
+		}
+
+	case toolkit.M:
+		for k, pv := range x {
+			props[k] = fmt.Sprintf("%v", pv)
+		}
+
+	default:
+		return nil, toolkit.Errorf("%v is not a list of KEY:value pairs", v)
+	}
+	return props, nil
+}
+
+func mechOrDefault(mech string) string {
+	if mech == "" {
+		return "default"
+	}
+	return mech
+}
@@ -0,0 +1,120 @@
+package flexmgo
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// collection is what Query and Cursor use of a collection. It is served by
+// the driver for mongodb connections and by a memCollection for mongomem.
+type collection interface {
+	Name() string
+	Database() string
+
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error)
+	InsertOne(ctx context.Context, doc interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+	UpdateOne(ctx context.Context, filter, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	UpdateMany(ctx context.Context, filter, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error)
+	Watch(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (*mongo.ChangeStream, error)
+
+	// Count runs the count command of the collection
+	Count(ctx context.Context, filter interface{}) (int64, error)
+	// RunCommand and RunCommandCursor run cmd on the database of the
+	// collection
+	RunCommand(ctx context.Context, cmd interface{}) *mongo.SingleResult
+	RunCommandCursor(ctx context.Context, cmd interface{}) (*mongo.Cursor, error)
+	// Bucket returns the GridFS bucket named after the collection
+	Bucket(chunkSize int32) (fileBucket, error)
+}
+
+// fileBucket is what Query uses of a GridFS bucket
+type fileBucket interface {
+	SetReadDeadline(time.Time) error
+	SetWriteDeadline(time.Time) error
+	UploadFromStream(filename string, source io.Reader, opts ...*options.UploadOptions) (primitive.ObjectID, error)
+	UploadFromStreamWithID(id interface{}, filename string, source io.Reader, opts ...*options.UploadOptions) error
+	OpenDownloadStream(id interface{}) (io.ReadCloser, error)
+	OpenDownloadStreamByName(filename string) (io.ReadCloser, error)
+	DeleteContext(ctx context.Context, id interface{}) error
+	DropContext(ctx context.Context) error
+}
+
+// mongoCollection is a collection served by the driver
+type mongoCollection struct {
+	*mongo.Collection
+	//-- readPref is given to the read commands, the driver only applies the
+	//-- collection one to its own methods
+	readPref *readpref.ReadPref
+}
+
+func (c mongoCollection) Database() string {
+	return c.Collection.Database().Name()
+}
+
+func (c mongoCollection) Count(ctx context.Context, filter interface{}) (int64, error) {
+	sr := c.Collection.Database().RunCommand(ctx, struct {
+		Count string      `bson:"count"`
+		Query interface{} `bson:"query"`
+	}{c.Name(), filter}, c.readOptions())
+	if err := sr.Err(); err != nil {
+		return 0, err
+	}
+
+	res := struct {
+		N int64 `bson:"n"`
+	}{}
+	if err := sr.Decode(&res); err != nil {
+		return 0, err
+	}
+	return res.N, nil
+}
+
+func (c mongoCollection) RunCommand(ctx context.Context, cmd interface{}) *mongo.SingleResult {
+	return c.Collection.Database().RunCommand(ctx, cmd)
+}
+
+func (c mongoCollection) RunCommandCursor(ctx context.Context, cmd interface{}) (*mongo.Cursor, error) {
+	return c.Collection.Database().RunCommandCursor(ctx, cmd, c.readOptions())
+}
+
+// readOptions runs a command with the read preference of the collection
+// instead of the primary one of RunCommand
+func (c mongoCollection) readOptions() *options.RunCmdOptions {
+	opts := options.RunCmd()
+	if c.readPref != nil {
+		opts.SetReadPreference(c.readPref)
+	}
+	return opts
+}
+
+func (c mongoCollection) Bucket(chunkSize int32) (fileBucket, error) {
+	opts := options.GridFSBucket().SetName(c.Name()).SetChunkSizeBytes(chunkSize)
+	bucket, err := gridfs.NewBucket(c.Collection.Database(), opts)
+	if err != nil {
+		return nil, err
+	}
+	return mongoBucket{bucket}, nil
+}
+
+// mongoBucket is a GridFS bucket served by the driver
+type mongoBucket struct {
+	*gridfs.Bucket
+}
+
+func (b mongoBucket) OpenDownloadStream(id interface{}) (io.ReadCloser, error) {
+	return b.Bucket.OpenDownloadStream(id)
+}
+
+func (b mongoBucket) OpenDownloadStreamByName(filename string) (io.ReadCloser, error) {
+	return b.Bucket.OpenDownloadStreamByName(filename)
+}
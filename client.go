@@ -0,0 +1,288 @@
+package flexmgo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.eaciitapp.com/sebar/dbflex"
+	"github.com/eaciit/toolkit"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sharedClient is a mongo.Client used by all connections having the same
+// hosts, credentials and config. It is disconnected once the last of them is
+// closed and the cursors, transactions and calls using it are done. When the
+// reconnect policy is on, the client is rebuilt in place if the deployment
+// becomes unreachable, the old one is disconnected the same way.
+type sharedClient struct {
+	mtx    sync.RWMutex
+	client *mongo.Client
+	health *healthMonitor
+	opts   *options.ClientOptions
+	policy healthPolicy
+
+	//-- users counts the work in flight on each client, retired are the
+	//-- clients released or replaced by reconnect that still have users
+	users   map[*mongo.Client]int
+	retired map[*mongo.Client]bool
+
+	err   error
+	refs  int
+	ready chan struct{}
+
+	reconnecting bool
+	backoff      time.Duration
+	nextAttempt  time.Time
+}
+
+// disconnectTimeout bounds the disconnection of a client. It does not use the
+// context of a connection, which may be done by then.
+const disconnectTimeout = 10 * time.Second
+
+var (
+	clientsMtx sync.Mutex
+	clients    = map[string]*sharedClient{}
+)
+
+// clientKey identifies the client of the connection. Hosts and config keys
+// are normalised so the same server info written differently share a client.
+// The database is not part of the key, connections to several databases of
+// one cluster use the same client.
+func (c *Connection) clientKey() string {
+	hosts := []string{}
+	for _, h := range strings.Split(c.Host, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	sort.Strings(hosts)
+
+	configs := []string{}
+	for k, v := range c.Config {
+		configs = append(configs, fmt.Sprintf("%s=%v", strings.ToLower(k), v))
+	}
+	sort.Strings(configs)
+
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		strings.Join(hosts, ","),
+		c.User,
+		c.Password,
+		strings.Join(configs, "&"),
+	}, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// acquireClient returns the client registered under key, creating and
+// connecting it with opts when there is none yet
+func acquireClient(ctx context.Context, key string, opts *options.ClientOptions, policy healthPolicy) (*sharedClient, error) {
+	clientsMtx.Lock()
+	sc, ok := clients[key]
+	if ok {
+		sc.refs++
+		clientsMtx.Unlock()
+
+		<-sc.ready
+		if sc.err != nil {
+			return nil, sc.err
+		}
+		return sc, nil
+	}
+
+	sc = &sharedClient{refs: 1, ready: make(chan struct{}), opts: opts, policy: policy,
+		users: map[*mongo.Client]int{}, retired: map[*mongo.Client]bool{}}
+	clients[key] = sc
+	clientsMtx.Unlock()
+
+	sc.client, sc.health, sc.err = newClient(ctx, opts)
+	if sc.err != nil {
+		clientsMtx.Lock()
+		if clients[key] == sc {
+			delete(clients, key)
+		}
+		clientsMtx.Unlock()
+	}
+	close(sc.ready)
+	if sc.err != nil {
+		return nil, sc.err
+	}
+	return sc, nil
+}
+
+// retainClient adds a reference to the client registered under key, it
+// returns false if there is none
+func retainClient(key string) bool {
+	clientsMtx.Lock()
+	defer clientsMtx.Unlock()
+	sc, ok := clients[key]
+	if ok {
+		sc.refs++
+	}
+	return ok
+}
+
+// releaseClient drops a reference to the client registered under key. After
+// the last one the client is disconnected, once the cursors and calls using
+// it are done.
+func releaseClient(key string) error {
+	clientsMtx.Lock()
+	sc, ok := clients[key]
+	if !ok {
+		clientsMtx.Unlock()
+		return nil
+	}
+
+	sc.refs--
+	if sc.refs > 0 {
+		clientsMtx.Unlock()
+		return nil
+	}
+	delete(clients, key)
+	clientsMtx.Unlock()
+
+	sc.mtx.Lock()
+	client := sc.client
+	if sc.users[client] > 0 {
+		sc.retired[client] = true
+		sc.mtx.Unlock()
+		return nil
+	}
+	sc.mtx.Unlock()
+	return disconnect(client)
+}
+
+// disconnect disconnects client with a context of its own
+func disconnect(client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+	defer cancel()
+	return client.Disconnect(ctx)
+}
+
+// newClient connects a client reporting its topology changes to a new
+// healthMonitor. opts is not changed.
+func newClient(ctx context.Context, opts *options.ClientOptions) (*mongo.Client, *healthMonitor, error) {
+	health := new(healthMonitor)
+	clone := *opts
+	opts = clone.SetServerMonitor(health.serverMonitor())
+
+	client, err := mongo.NewClient(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = client.Connect(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	if err = client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, nil, err
+	}
+	health.pingAt = time.Now()
+	return client, health, nil
+}
+
+func (sc *sharedClient) current() *mongo.Client {
+	sc.mtx.RLock()
+	defer sc.mtx.RUnlock()
+	return sc.client
+}
+
+// use returns the current client and counts it as used until done is called,
+// so reconnect does not disconnect it under a running cursor or call
+func (sc *sharedClient) use() (client *mongo.Client, done func()) {
+	sc.mtx.Lock()
+	client = sc.client
+	sc.users[client]++
+	sc.mtx.Unlock()
+
+	var once sync.Once
+	return client, func() {
+		once.Do(func() { sc.done(client) })
+	}
+}
+
+func (sc *sharedClient) done(client *mongo.Client) {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	if sc.users[client]--; sc.users[client] > 0 {
+		return
+	}
+	delete(sc.users, client)
+	if sc.retired[client] {
+		delete(sc.retired, client)
+		go disconnect(client)
+	}
+}
+
+// retire disconnects old once it has no users, sc.mtx is held by the caller
+func (sc *sharedClient) retire(old *mongo.Client) {
+	if sc.users[old] > 0 {
+		sc.retired[old] = true
+		return
+	}
+	go disconnect(old)
+}
+
+// state returns the health of the client. If it is disconnected and the
+// reconnect policy is on, the client is rebuilt once the backoff has elapsed.
+func (sc *sharedClient) state(ctx context.Context) string {
+	sc.mtx.RLock()
+	client, health := sc.client, sc.health
+	sc.mtx.RUnlock()
+
+	state := health.state(ctx, client, sc.policy.pingTTL)
+	if state != StateDisconnected || !sc.policy.reconnect {
+		return state
+	}
+
+	if err := sc.reconnect(ctx, client); err != nil {
+		dbflex.Logger().Warningf("unable to reconnect. %s", err.Error())
+		return state
+	}
+
+	sc.mtx.RLock()
+	client, health = sc.client, sc.health
+	sc.mtx.RUnlock()
+	return health.state(ctx, client, sc.policy.pingTTL)
+}
+
+// reconnect replaces old with a new client. Attempts are spaced by an
+// exponential backoff between the policy min and max backoff, an attempt
+// that is not due yet is skipped.
+func (sc *sharedClient) reconnect(ctx context.Context, old *mongo.Client) error {
+	sc.mtx.Lock()
+	if sc.client != old || sc.reconnecting || time.Now().Before(sc.nextAttempt) {
+		sc.mtx.Unlock()
+		return nil
+	}
+	sc.reconnecting = true
+	sc.mtx.Unlock()
+
+	client, health, err := newClient(ctx, sc.opts)
+
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	sc.reconnecting = false
+	if err != nil {
+		if sc.backoff == 0 {
+			sc.backoff = sc.policy.minBackoff
+		} else if sc.backoff *= 2; sc.backoff > sc.policy.maxBackoff {
+			sc.backoff = sc.policy.maxBackoff
+		}
+		sc.nextAttempt = time.Now().Add(sc.backoff)
+		return toolkit.Errorf("%s, next attempt in %s", err.Error(), sc.backoff)
+	}
+
+	sc.client, sc.health = client, health
+	sc.backoff = 0
+	sc.nextAttempt = time.Time{}
+	sc.retire(old)
+	return nil
+}
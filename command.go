@@ -0,0 +1,397 @@
+package flexmgo
+
+import (
+	"sort"
+	"strings"
+
+	df "git.eaciitapp.com/sebar/dbflex"
+	"github.com/eaciit/toolkit"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Explain verbosities, from the plan only to the statistics of every plan
+// the server tried
+const (
+	ExplainQueryPlanner      = "queryPlanner"
+	ExplainExecutionStats    = "executionStats"
+	ExplainAllPlansExecution = "allPlansExecution"
+)
+
+// Command returns the command document Cursor(m) or Execute(m) sends for the
+// query: a find, aggregate, insert, update or delete. The documents written
+// come from the data of m, without it they are left out. GridFS and watch
+// commands do not have one, it is nil.
+func (q *Query) Command(m toolkit.M) (bson.D, error) {
+	conn := q.Connection().(*Connection)
+	database, _ := q.setting(m, KeyDatabase).(string)
+	_, name := conn.splitTable(q.Config(df.ConfigKeyTableName, "").(string), database)
+
+	parts := q.Config(df.ConfigKeyGroupedQueryItems, df.GroupedQueryItems{}).(df.GroupedQueryItems)
+	where := q.Config(df.ConfigKeyWhere, toolkit.M{}).(toolkit.M)
+	if where == nil {
+		where = toolkit.M{}
+	}
+	data, hasData := m["data"]
+
+	switch q.Config(df.ConfigKeyCommandType, "N/A") {
+	case df.QueryInsert:
+		docs := []interface{}{}
+		if hasData {
+			docs = append(docs, data)
+		}
+		return bson.D{{Key: "insert", Value: name}, {Key: "documents", Value: docs}}, nil
+
+	case df.QueryUpdate:
+		update := bson.D{{Key: "q", Value: where}}
+		if hasData {
+			dataS, err := updateData(data, parts)
+			if err != nil {
+				return nil, err
+			}
+			update = append(update, bson.E{Key: "u", Value: dataS})
+		}
+		update = append(update, bson.E{Key: "multi", Value: true}, bson.E{Key: "upsert", Value: true})
+		return bson.D{{Key: "update", Value: name}, {Key: "updates", Value: []bson.D{update}}}, nil
+
+	case df.QuerySave:
+		update := bson.D{}
+		if hasData {
+			whereSave, datam, err := saveData(data)
+			if err != nil {
+				return nil, err
+			}
+			update = append(update, bson.E{Key: "q", Value: whereSave},
+				bson.E{Key: "u", Value: toolkit.M{}.Set("$set", datam)})
+		}
+		update = append(update, bson.E{Key: "multi", Value: true}, bson.E{Key: "upsert", Value: true})
+		return bson.D{{Key: "update", Value: name}, {Key: "updates", Value: []bson.D{update}}}, nil
+
+	case df.QueryDelete:
+		deletes := []bson.D{{{Key: "q", Value: where}, {Key: "limit", Value: 0}}}
+		return bson.D{{Key: "delete", Value: name}, {Key: "deletes", Value: deletes}}, nil
+
+	case df.QueryCommand:
+		switch cmd := commandOf(parts).(type) {
+		case toolkit.M, bson.D:
+			return commandDoc(cmd)
+		}
+		return nil, nil
+	}
+
+	qo, err := q.queryOptions(m)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := parts[df.QueryAggr]; ok {
+		return qo.aggregateCommand(aggregateCommand(name, aggrPipeline(where, parts), true)), nil
+	}
+	if gn := q.setting(m, KeyGeoNear); gn != nil {
+		pipes, err := geoNearPipeline(gn, where, parts)
+		if err != nil {
+			return nil, err
+		}
+		return qo.aggregateCommand(aggregateCommand(name, pipes, false)), nil
+	}
+	projection, sort, err := q.findDocs(m, parts)
+	if err != nil {
+		return nil, err
+	}
+	find := bson.D{{Key: "find", Value: name}, {Key: "filter", Value: where}}
+	if len(projection) > 0 {
+		find = append(find, bson.E{Key: "projection", Value: projection})
+	}
+	if len(sort) > 0 {
+		find = append(find, bson.E{Key: "sort", Value: sort})
+	}
+	if items, ok := parts[df.QuerySkip]; ok {
+		find = append(find, bson.E{Key: "skip", Value: items[0].Value})
+	}
+	if items, ok := parts[df.QueryTake]; ok {
+		find = append(find, bson.E{Key: "limit", Value: items[0].Value})
+	}
+	return qo.findCommand(find), nil
+}
+
+func aggregateCommand(name string, pipes []toolkit.M, allowDiskUse bool) bson.D {
+	cmd := bson.D{{Key: "aggregate", Value: name}, {Key: "pipeline", Value: pipes}}
+	if allowDiskUse {
+		cmd = append(cmd, bson.E{Key: "allowDiskUse", Value: true})
+	}
+	return append(cmd, bson.E{Key: "cursor", Value: bson.D{}})
+}
+
+// commandNames are the commands a raw toolkit.M command is recognised by
+var commandNames = map[string]bool{
+	"aggregate": true, "count": true, "distinct": true, "find": true, "findAndModify": true,
+	"getMore": true, "insert": true, "update": true, "delete": true, "mapReduce": true,
+	"create": true, "createIndexes": true, "drop": true, "dropIndexes": true, "listIndexes": true,
+	"listCollections": true, "collMod": true, "collStats": true, "dbStats": true, "explain": true,
+	"validate": true, "renameCollection": true, "killCursors": true, "ping": true,
+	"buildInfo": true, "serverStatus": true, "hello": true, "isMaster": true,
+	"currentOp": true, "killOp": true, "dropDatabase": true,
+}
+
+// commandDoc is the raw command cmd as the server reads it, with the
+// command name as its first key. A bson.D is taken as is. A toolkit.M has no
+// order of its own, its command name is found in commandNames, or is its
+// only key, and the other keys follow sorted.
+func commandDoc(cmd interface{}) (bson.D, error) {
+	if d, ok := cmd.(bson.D); ok {
+		return d, nil
+	}
+	m, ok := cmd.(toolkit.M)
+	if !ok {
+		return nil, toolkit.Errorf("invalid command %v", cmd)
+	}
+
+	name, keys := "", []string{}
+	for k := range m {
+		if commandNames[k] || len(m) == 1 {
+			if name != "" {
+				return nil, toolkit.Errorf("command has two names %s and %s, give it as a bson.D", name, k)
+			}
+			name = k
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if name == "" {
+		return nil, toolkit.Errorf("unable to find the name of command %s, give it as a bson.D", toolkit.JsonString(m))
+	}
+	sort.Strings(keys)
+	doc := bson.D{{Key: name, Value: m[name]}}
+	for _, k := range keys {
+		doc = append(doc, bson.E{Key: k, Value: m[k]})
+	}
+	return doc, nil
+}
+
+// aggrPipeline is the $match and $group pipeline of the aggregations of a
+// cursor
+func aggrPipeline(where toolkit.M, parts df.GroupedQueryItems) []toolkit.M {
+	pipes := []toolkit.M{}
+	items := parts[df.QueryAggr][0].Value.([]*df.AggrItem)
+	aggrExpression := toolkit.M{}
+	for _, item := range items {
+		if item.Op == df.AggrCount {
+			aggrExpression.Set(item.Alias, toolkit.M{}.Set(string(df.AggrSum), 1))
+		} else {
+			aggrExpression.Set(item.Alias, toolkit.M{}.Set(string(item.Op), "$"+item.Field))
+		}
+	}
+	if groupby, hasGroup := parts[df.QueryGroup]; !hasGroup {
+		aggrExpression.Set("_id", "")
+	} else {
+		groups := toolkit.M{}
+		for _, v := range groupby {
+			for _, g := range v.Value.([]string) {
+				if strings.TrimSpace(g) != "" {
+					groups.Set(strings.Replace(g, ".", "_", -1), "$"+g)
+				}
+			}
+		}
+		aggrExpression.Set("_id", groups)
+	}
+
+	if where != nil {
+		pipes = append(pipes, toolkit.M{}.Set("$match", where))
+	}
+	return append(pipes, toolkit.M{}.Set("$group", aggrExpression))
+}
+
+// updateData is the update document of an Update, a $set of the fields of
+// data given to Update or of all of them. Data that is already an update
+// document, having operators such as $inc, is used as is when no field is
+// given.
+func updateData(data interface{}, parts df.GroupedQueryItems) (toolkit.M, error) {
+	//-- get the field for update
+	updateqi, _ := parts[df.QueryUpdate]
+	updatevals := updateqi[0].Value.([]string)
+
+	dataM, err := toolkit.ToM(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(updatevals) == 0 && isUpdateDocument(dataM) {
+		return dataM, nil
+	}
+
+	dataS := toolkit.M{}
+	for k, v := range dataM {
+		if len(updatevals) == 0 {
+			dataS[k] = v
+			continue
+		}
+		for _, u := range updatevals {
+			if strings.ToLower(k) == strings.ToLower(u) {
+				dataS[k] = v
+			}
+		}
+	}
+	return toolkit.M{}.Set("$set", dataS), nil
+}
+
+// isUpdateDocument returns true if all the keys of m are update operators
+func isUpdateDocument(m toolkit.M) bool {
+	if len(m) == 0 {
+		return false
+	}
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// saveData returns the filter on the _id of data and data as a toolkit.M
+func saveData(data interface{}) (toolkit.M, toolkit.M, error) {
+	datam, err := toolkit.ToM(data)
+	if err != nil {
+		return nil, nil, toolkit.Errorf("unable to deserialize data: %s", err.Error())
+	}
+	if !datam.Has("_id") {
+		return nil, nil, toolkit.Error("_id field is required")
+	}
+	return toolkit.M{}.Set("_id", datam.Get("_id")), datam, nil
+}
+
+// Explain runs the command of the query with the explain verbosity, default
+// ExplainQueryPlanner, without running its writes. The plan of the server is
+// under "plan", with a summary of it: whether an index was used in
+// "indexUsed", which ones in "indexes" and the stages of the winning plan in
+// "stages". With execution stats "returned", "docsExamined", "keysExamined"
+// and "executionTimeMillis" are set as well.
+func (q *Query) Explain(m toolkit.M, verbosity string) (toolkit.M, error) {
+	switch verbosity {
+	case "":
+		verbosity = ExplainQueryPlanner
+	case ExplainQueryPlanner, ExplainExecutionStats, ExplainAllPlansExecution:
+	default:
+		return nil, toolkit.Errorf("invalid explain verbosity %s", verbosity)
+	}
+
+	cmd, err := q.Command(m)
+	if err != nil {
+		return nil, err
+	}
+	if cmd == nil {
+		return nil, toolkit.Errorf("the query has no command to explain")
+	}
+
+	conn := q.Connection().(*Connection)
+	coll, done, err := q.collection(conn, q.Config(df.ConfigKeyTableName, "").(string), m)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	ctx, span := q.startSpan(q.context(m), m, "explain")
+	sr := coll.RunCommand(ctx, bson.D{{Key: "explain", Value: cmd}, {Key: "verbosity", Value: verbosity}})
+	plan := toolkit.M{}
+	err = sr.Err()
+	if err == nil {
+		err = sr.Decode(&plan)
+	}
+	endSpan(span, err)
+	if err != nil {
+		return nil, toolkit.Errorf("unable to explain %s. %s", cmd[0].Key, err.Error())
+	}
+	return explainSummary(plan, verbosity), nil
+}
+
+// Explain is Query.Explain of cmd
+func (c *Connection) Explain(cmd df.ICommand, m toolkit.M, verbosity string) (toolkit.M, error) {
+	q, err := c.Prepare(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return q.(*Query).Explain(m, verbosity)
+}
+
+// explainSummary summarises the explain output plan
+func explainSummary(plan toolkit.M, verbosity string) toolkit.M {
+	res := toolkit.M{}.Set("verbosity", verbosity).Set("plan", plan)
+
+	//-- an aggregate has the plan of its first stage
+	planner, stats := subM(plan["queryPlanner"]), subM(plan["executionStats"])
+	if stages := subA(plan["stages"]); len(stages) > 0 {
+		first := subM(subM(stages[0])["$cursor"])
+		planner, stats = subM(first["queryPlanner"]), subM(first["executionStats"])
+	}
+
+	winning := subM(planner["winningPlan"])
+	if qp, ok := winning["queryPlan"]; ok {
+		winning = subM(qp)
+	}
+	stages, indexes := []string{}, []string{}
+	planStages(winning, &stages, &indexes)
+	res.Set("stages", stages).Set("indexes", indexes).Set("indexUsed", len(indexes) > 0)
+
+	if verbosity != ExplainQueryPlanner && len(stats) > 0 {
+		res.Set("returned", stats.GetInt("nReturned")).
+			Set("docsExamined", stats.GetInt("totalDocsExamined")).
+			Set("keysExamined", stats.GetInt("totalKeysExamined")).
+			Set("executionTimeMillis", stats.GetInt("executionTimeMillis"))
+	}
+	return res
+}
+
+// planStages walks the stages of plan from the top, adding the index of
+// each index scan to indexes
+func planStages(plan toolkit.M, stages, indexes *[]string) {
+	stage := plan.GetString("stage")
+	if stage == "" {
+		return
+	}
+	*stages = append(*stages, stage)
+	name := plan.GetString("indexName")
+	if stage == "IDHACK" || stage == "EXPRESS_IDHACK" {
+		//-- a lookup by _id has no index name, it is the _id index
+		name = "_id_"
+	}
+	for _, index := range *indexes {
+		if index == name {
+			name = ""
+		}
+	}
+	if name != "" {
+		*indexes = append(*indexes, name)
+	}
+	if input, ok := plan["inputStage"]; ok {
+		planStages(subM(input), stages, indexes)
+	}
+	for _, input := range subA(plan["inputStages"]) {
+		planStages(subM(input), stages, indexes)
+	}
+}
+
+// subM returns the document v as a toolkit.M, or an empty one
+func subM(v interface{}) toolkit.M {
+	switch x := v.(type) {
+	case toolkit.M:
+		return x
+	case map[string]interface{}:
+		return toolkit.M(x)
+	case bson.M:
+		return toolkit.M(x)
+	case bson.D:
+		m := toolkit.M{}
+		for _, e := range x {
+			m.Set(e.Key, e.Value)
+		}
+		return m
+	}
+	return toolkit.M{}
+}
+
+// subA returns the array v as a slice, or nil
+func subA(v interface{}) []interface{} {
+	switch x := v.(type) {
+	case bson.A:
+		return x
+	case []interface{}:
+		return x
+	}
+	return nil
+}
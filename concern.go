@@ -0,0 +1,223 @@
+package flexmgo
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eaciit/toolkit"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/tag"
+)
+
+// Keys of the read preference, read concern and write concern settings. They
+// are read from the connection Config as defaults and can be overridden per
+// query through the query config or the toolkit.M given to Cursor and Execute.
+const (
+	KeyReadPreference     = "readPreference"
+	KeyReadPreferenceTags = "readPreferenceTags"
+	KeyMaxStaleness       = "maxStalenessSeconds"
+	KeyReadConcern        = "readConcernLevel"
+	KeyWriteConcern       = "w"
+	KeyJournal            = "journal"
+	KeyWTimeout           = "wtimeoutMS"
+)
+
+var readConcernLevels = map[string]bool{
+	"local":        true,
+	"available":    true,
+	"majority":     true,
+	"linearizable": true,
+	"snapshot":     true,
+}
+
+// concernGetter returns the value of a setting key, nil when it is not set
+type concernGetter func(key string) interface{}
+
+// readPreference builds the read preference from mode, tag sets and max
+// staleness. Settings that are not given are taken from base, which may be
+// nil. It returns nil if no read preference setting is given.
+func readPreference(get concernGetter, base *readpref.ReadPref) (*readpref.ReadPref, error) {
+	modeValue, tagsValue, stalenessValue := get(KeyReadPreference), get(KeyReadPreferenceTags), get(KeyMaxStaleness)
+	if modeValue == nil && tagsValue == nil && stalenessValue == nil {
+		return nil, nil
+	}
+
+	mode := readpref.PrimaryMode
+	if modeValue != nil {
+		modeName := strings.TrimSpace(fmt.Sprintf("%v", modeValue))
+		m, err := readpref.ModeFromString(modeName)
+		if err != nil {
+			return nil, toolkit.Errorf("invalid %s %s", KeyReadPreference, modeName)
+		}
+		mode = m
+	} else if base != nil {
+		mode = base.Mode()
+	}
+	if mode == readpref.PrimaryMode && (tagsValue != nil || stalenessValue != nil) {
+		return nil, toolkit.Errorf("%s and %s need a %s other than primary",
+			KeyReadPreferenceTags, KeyMaxStaleness, KeyReadPreference)
+	}
+
+	rpOpts := []readpref.Option{}
+	if tagsValue != nil {
+		tagSets, err := readPreferenceTags(tagsValue)
+		if err != nil {
+			return nil, err
+		}
+		rpOpts = append(rpOpts, readpref.WithTagSets(tag.NewTagSetsFromMaps(tagSets)...))
+	} else if base != nil && mode != readpref.PrimaryMode && len(base.TagSets()) > 0 {
+		rpOpts = append(rpOpts, readpref.WithTagSets(base.TagSets()...))
+	}
+	if stalenessValue != nil {
+		staleness, err := configDuration(stalenessValue, time.Second)
+		if err != nil {
+			return nil, toolkit.Errorf("invalid %s. %s", KeyMaxStaleness, err.Error())
+		}
+		rpOpts = append(rpOpts, readpref.WithMaxStaleness(staleness))
+	} else if base != nil && mode != readpref.PrimaryMode {
+		if staleness, ok := base.MaxStaleness(); ok {
+			rpOpts = append(rpOpts, readpref.WithMaxStaleness(staleness))
+		}
+	}
+
+	rp, err := readpref.New(mode, rpOpts...)
+	if err != nil {
+		return nil, toolkit.Errorf("invalid read preference. %s", err.Error())
+	}
+	return rp, nil
+}
+
+// readPreferenceTags reads tag sets given as "dc:ny,rack:1" strings, one per
+// tag set, or as maps
+func readPreferenceTags(v interface{}) ([]map[string]string, error) {
+	tagSets := []map[string]string{}
+	switch x := v.(type) {
+	case string, map[string]string, toolkit.M:
+		ts, err := configPairs(x)
+		if err != nil {
+			return nil, toolkit.Errorf("invalid %s. %s", KeyReadPreferenceTags, err.Error())
+		}
+		tagSets = append(tagSets, ts)
+
+	case []string:
+		for _, s := range x {
+			ts, err := readPreferenceTags(s)
+			if err != nil {
+				return nil, err
+			}
+			tagSets = append(tagSets, ts...)
+		}
+
+	case []map[string]string:
+		tagSets = append(tagSets, x...)
+
+	case []toolkit.M:
+		for _, m := range x {
+			ts, err := readPreferenceTags(m)
+			if err != nil {
+				return nil, err
+			}
+			tagSets = append(tagSets, ts...)
+		}
+
+	default:
+		return nil, toolkit.Errorf("invalid %s %v", KeyReadPreferenceTags, v)
+	}
+	return tagSets, nil
+}
+
+// readConcern returns nil if no read concern level is given
+func readConcern(get concernGetter) (*readconcern.ReadConcern, error) {
+	v := get(KeyReadConcern)
+	if v == nil {
+		return nil, nil
+	}
+
+	level := strings.ToLower(strings.TrimSpace(fmt.Sprintf("%v", v)))
+	if !readConcernLevels[level] {
+		return nil, toolkit.Errorf("invalid %s %v", KeyReadConcern, v)
+	}
+	return readconcern.New(readconcern.Level(level)), nil
+}
+
+// writeConcern builds the write concern from w, journal and wtimeout. Those
+// that are not given are taken from base, which may be nil. It returns nil
+// if none of them is given.
+func writeConcern(get concernGetter, base *writeconcern.WriteConcern) (*writeconcern.WriteConcern, error) {
+	wValue, jValue, timeoutValue := get(KeyWriteConcern), get(KeyJournal), get(KeyWTimeout)
+	if wValue == nil && jValue == nil && timeoutValue == nil {
+		return nil, nil
+	}
+
+	wc := new(writeconcern.WriteConcern)
+	if base != nil {
+		*wc = *base
+	}
+	if wValue != nil {
+		if w, err := configInt(wValue); err == nil {
+			if w < 0 {
+				return nil, toolkit.Errorf("invalid %s %d", KeyWriteConcern, w)
+			}
+			wc.W = int(w)
+		} else if wTag := strings.TrimSpace(fmt.Sprintf("%v", wValue)); wTag != "" {
+			wc.W = wTag
+		} else {
+			return nil, toolkit.Errorf("invalid %s %v", KeyWriteConcern, wValue)
+		}
+	}
+	if jValue != nil {
+		j, err := configBool(jValue)
+		if err != nil {
+			return nil, toolkit.Errorf("invalid %s. %s", KeyJournal, err.Error())
+		}
+		wc.Journal = &j
+	}
+	if timeoutValue != nil {
+		timeout, err := configDuration(timeoutValue, time.Millisecond)
+		if err != nil {
+			return nil, toolkit.Errorf("invalid %s. %s", KeyWTimeout, err.Error())
+		}
+		wc.WTimeout = timeout
+	}
+
+	if !wc.IsValid() {
+		return nil, toolkit.Errorf("invalid write concern, journal can not be used with w 0")
+	}
+	return wc, nil
+}
+
+// collectionOptions returns the read preference, read concern and write
+// concern found by get as collection options. They are layered on the ones of
+// db, so a query only overrides the settings it gives.
+func collectionOptions(get concernGetter, db *mongo.Database) (*options.CollectionOptions, error) {
+	opts := options.Collection()
+	rp, err := readPreference(get, db.ReadPreference())
+	if err != nil {
+		return nil, err
+	}
+	if rp != nil {
+		opts.SetReadPreference(rp)
+	}
+
+	rc, err := readConcern(get)
+	if err != nil {
+		return nil, err
+	}
+	if rc != nil {
+		opts.SetReadConcern(rc)
+	}
+
+	wc, err := writeConcern(get, db.WriteConcern())
+	if err != nil {
+		return nil, err
+	}
+	if wc != nil {
+		opts.SetWriteConcern(wc)
+	}
+	return opts, nil
+}
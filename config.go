@@ -0,0 +1,380 @@
+package flexmgo
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eaciit/toolkit"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// uriOptions are the standard connection string options. They are passed
+// through to the driver as part of the URI. Keys are lower case, values are
+// the canonical name used in the URI.
+var uriOptions = map[string]string{
+	"appname":                  "appName",
+	"authmechanism":            "authMechanism",
+	"authmechanismproperties":  "authMechanismProperties",
+	"authsource":               "authSource",
+	"compressors":              "compressors",
+	"connecttimeoutms":         "connectTimeoutMS",
+	"directconnection":         "directConnection",
+	"heartbeatfrequencyms":     "heartbeatFrequencyMS",
+	"loadbalanced":             "loadBalanced",
+	"localthresholdms":         "localThresholdMS",
+	"maxconnecting":            "maxConnecting",
+	"maxidletimems":            "maxIdleTimeMS",
+	"maxpoolsize":              "maxPoolSize",
+	"minpoolsize":              "minPoolSize",
+	"replicaset":               "replicaSet",
+	"retryreads":               "retryReads",
+	"retrywrites":              "retryWrites",
+	"serverselectiontimeoutms": "serverSelectionTimeoutMS",
+	"serverselectiontryonce":   "serverSelectionTryOnce",
+	"sockettimeoutms":          "socketTimeoutMS",
+	"srvmaxhosts":              "srvMaxHosts",
+	"srvservicename":           "srvServiceName",
+	"zlibcompressionlevel":     "zlibCompressionLevel",
+	"zstdcompressionlevel":     "zstdCompressionLevel",
+}
+
+// authOptions are connection string options validated by authCredential
+// before being written to the URI
+var authOptions = map[string]bool{
+	"authsource":              true,
+	"authmechanism":           true,
+	"authmechanismproperties": true,
+}
+
+// concernOptions are read by readPreference, readConcern and writeConcern
+var concernOptions = map[string]bool{
+	"readpreference":      true,
+	"readpreferencetags":  true,
+	"maxstalenessseconds": true,
+	"readconcernlevel":    true,
+	"w":                   true,
+	"journal":             true,
+	"wtimeoutms":          true,
+}
+
+// connectionOptions are flexmgo config keys that do not change the client
+// options. They are read by healthPolicy and validationSettings.
+var connectionOptions = map[string]bool{
+	"healthcheckinterval":  true,
+	"reconnect":            true,
+	"reconnectinterval":    true,
+	"reconnectmaxinterval": true,
+	"validationlevel":      true,
+	"validationaction":     true,
+}
+
+// minHeartbeatInterval is the lowest heartbeat the driver accepts, as it does
+// for heartbeatFrequencyMS in a connection string
+const minHeartbeatInterval = 500 * time.Millisecond
+
+// configHandler applies a flexmgo specific config key to the client options
+type configHandler func(opts *options.ClientOptions, v interface{}) error
+
+// configHandlers are config keys understood by flexmgo itself, keyed by their
+// lower case name. Their values are validated before being applied.
+var configHandlers = map[string]configHandler{
+	"serverselectiontimeout": durationHandler((*options.ClientOptions).SetServerSelectionTimeout),
+	"connecttimeout":         durationHandler((*options.ClientOptions).SetConnectTimeout),
+	"sockettimeout":          durationHandler((*options.ClientOptions).SetSocketTimeout),
+	"maxconnidletime":        durationHandler((*options.ClientOptions).SetMaxConnIdleTime),
+	"heartbeatinterval":      durationHandler((*options.ClientOptions).SetHeartbeatInterval),
+	"localthreshold":         durationHandler((*options.ClientOptions).SetLocalThreshold),
+	"maxpoolsize":            poolSizeHandler((*options.ClientOptions).SetMaxPoolSize),
+	"minpoolsize":            poolSizeHandler((*options.ClientOptions).SetMinPoolSize),
+	"retrywrites":            boolHandler((*options.ClientOptions).SetRetryWrites),
+	"retryreads":             boolHandler((*options.ClientOptions).SetRetryReads),
+	"appname": func(opts *options.ClientOptions, v interface{}) error {
+		name := strings.TrimSpace(fmt.Sprintf("%v", v))
+		if name == "" {
+			return toolkit.Errorf("appName should not be empty")
+		}
+		opts.SetAppName(name)
+		return nil
+	},
+	"compressors": func(opts *options.ClientOptions, v interface{}) error {
+		var names []string
+		switch x := v.(type) {
+		case []string:
+			names = x
+		case string:
+			names = strings.Split(x, ",")
+		default:
+			return toolkit.Errorf("%v is not a list of compressors", v)
+		}
+
+		compressors := []string{}
+		for _, name := range names {
+			name = strings.ToLower(strings.TrimSpace(name))
+			switch name {
+			case "":
+			case "snappy", "zlib", "zstd":
+				compressors = append(compressors, name)
+			default:
+				return toolkit.Errorf("compressor %s is not supported, use snappy, zlib or zstd", name)
+			}
+		}
+		opts.SetCompressors(compressors)
+		return nil
+	},
+}
+
+// durationHandler reads a value in milliseconds
+func durationHandler(fn func(*options.ClientOptions, time.Duration) *options.ClientOptions) configHandler {
+	return func(opts *options.ClientOptions, v interface{}) error {
+		d, err := configDuration(v, time.Millisecond)
+		if err != nil {
+			return err
+		}
+		fn(opts, d)
+		return nil
+	}
+}
+
+func poolSizeHandler(fn func(*options.ClientOptions, uint64) *options.ClientOptions) configHandler {
+	return func(opts *options.ClientOptions, v interface{}) error {
+		i, err := configInt(v)
+		if err != nil {
+			return err
+		}
+		if i < 0 {
+			return toolkit.Errorf("%d should not be negative", i)
+		}
+		fn(opts, uint64(i))
+		return nil
+	}
+}
+
+func boolHandler(fn func(*options.ClientOptions, bool) *options.ClientOptions) configHandler {
+	return func(opts *options.ClientOptions, v interface{}) error {
+		b, err := configBool(v)
+		if err != nil {
+			return err
+		}
+		fn(opts, b)
+		return nil
+	}
+}
+
+// ConnectionString returns the standard mongodb URI built from the ServerInfo
+// of the connection: all hosts, credentials, database and the connection
+// string options found in Config
+func (c *Connection) ConnectionString() (string, error) {
+	hosts := []string{}
+	for _, h := range strings.Split(c.Host, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	if len(hosts) == 0 {
+		return "", toolkit.Errorf("host is required")
+	}
+
+	values := url.Values{}
+	for k, v := range c.Config {
+		klow := strings.ToLower(k)
+		if _, ok := configHandlers[klow]; ok || authOptions[klow] || concernOptions[klow] || connectionOptions[klow] || monitorOptions[klow] {
+			continue
+		}
+		if _, ok := tlsOptions[klow]; ok {
+			continue
+		}
+
+		name, ok := uriOptions[klow]
+		if !ok {
+			return "", toolkit.Errorf("unknown config key %s", k)
+		}
+
+		switch vs := v.(type) {
+		case []string:
+			for _, s := range vs {
+				values.Add(name, s)
+			}
+		default:
+			values.Add(name, fmt.Sprintf("%v", v))
+		}
+	}
+
+	cred, err := c.authCredential()
+	if err != nil {
+		return "", err
+	}
+	if cred != nil {
+		for k, v := range authURIValues(cred) {
+			values.Set(k, v)
+		}
+	}
+
+	//-- only the flag goes in the URI, ClientOptions builds the tls config
+	tlsSettings, err := c.tlsSettings()
+	if err != nil {
+		return "", err
+	}
+	if tlsSettings != nil {
+		values.Set("tls", "true")
+	}
+
+	connURI := "mongodb://"
+	if cred != nil && cred.Username != "" {
+		if cred.PasswordSet {
+			connURI += url.UserPassword(cred.Username, cred.Password).String() + "@"
+		} else {
+			connURI += url.User(cred.Username).String() + "@"
+		}
+	}
+	connURI += strings.Join(hosts, ",") + "/"
+	if c.Database != "" {
+		connURI += url.PathEscape(c.Database)
+	}
+	if len(values) > 0 {
+		connURI += "?" + values.Encode()
+	}
+	return connURI, nil
+}
+
+// ClientOptions returns the driver options used by Connect
+func (c *Connection) ClientOptions() (*options.ClientOptions, error) {
+	connURI, err := c.ConnectionString()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := options.Client().ApplyURI(connURI)
+	for k, v := range c.Config {
+		if fn, ok := configHandlers[strings.ToLower(k)]; ok {
+			if err = fn(opts, v); err != nil {
+				return nil, toolkit.Errorf("invalid value for config %s. %s", k, err.Error())
+			}
+		}
+	}
+
+	rp, err := readPreference(c.configValue, opts.ReadPreference)
+	if err != nil {
+		return nil, err
+	}
+	if rp != nil {
+		opts.SetReadPreference(rp)
+	}
+	rc, err := readConcern(c.configValue)
+	if err != nil {
+		return nil, err
+	}
+	if rc != nil {
+		opts.SetReadConcern(rc)
+	}
+	wc, err := writeConcern(c.configValue, opts.WriteConcern)
+	if err != nil {
+		return nil, err
+	}
+	if wc != nil {
+		opts.SetWriteConcern(wc)
+	}
+
+	if opts.HeartbeatInterval != nil && *opts.HeartbeatInterval < minHeartbeatInterval {
+		return nil, toolkit.Errorf("heartbeatInterval %s is less than %s",
+			*opts.HeartbeatInterval, minHeartbeatInterval)
+	}
+
+	tlsCfg, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil {
+		opts.SetTLSConfig(tlsCfg)
+	}
+
+	if opts.Auth != nil && opts.Auth.AuthMechanism == AuthX509 && opts.TLSConfig == nil {
+		return nil, toolkit.Errorf("authMechanism %s requires tls to be enabled", AuthX509)
+	}
+
+	monitor, err := c.commandMonitor()
+	if err != nil {
+		return nil, err
+	}
+	if monitor != nil {
+		opts.SetMonitor(monitor.eventMonitor())
+	}
+
+	//-- validated once everything is applied, so the values of flexmgo keys
+	//-- fail here rather than in Connect
+	if err = opts.Validate(); err != nil {
+		return nil, toolkit.Errorf("invalid client options. %s", err.Error())
+	}
+	return opts, nil
+}
+
+// configValue returns the Config value of key, matched case insensitively
+func (c *Connection) configValue(key string) interface{} {
+	for k, v := range c.Config {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return nil
+}
+
+func (c *Connection) configString(key string) string {
+	v := c.configValue(key)
+	if v == nil {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprintf("%v", v))
+}
+
+func configInt(v interface{}) (int64, error) {
+	switch x := v.(type) {
+	case int:
+		return int64(x), nil
+	case int32:
+		return int64(x), nil
+	case int64:
+		return x, nil
+	case uint64:
+		return int64(x), nil
+	case float64:
+		return int64(x), nil
+	case string:
+		i, err := strconv.ParseInt(strings.TrimSpace(x), 10, 64)
+		if err != nil {
+			return 0, toolkit.Errorf("%s is not a number", x)
+		}
+		return i, nil
+	}
+	return 0, toolkit.Errorf("%v is not a number", v)
+}
+
+func configBool(v interface{}) (bool, error) {
+	switch x := v.(type) {
+	case bool:
+		return x, nil
+	case string:
+		b, err := strconv.ParseBool(strings.TrimSpace(x))
+		if err != nil {
+			return false, toolkit.Errorf("%s is not a boolean", x)
+		}
+		return b, nil
+	}
+	return false, toolkit.Errorf("%v is not a boolean", v)
+}
+
+func configDuration(v interface{}, unit time.Duration) (time.Duration, error) {
+	if d, ok := v.(time.Duration); ok {
+		return d, nil
+	}
+
+	i, err := configInt(v)
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 {
+		return 0, toolkit.Errorf("%d should not be negative", i)
+	}
+	return time.Duration(i) * unit, nil
+}
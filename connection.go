@@ -3,91 +3,155 @@ package flexmgo
 import (
 	"context"
 	"strings"
-	"time"
 
 	"git.eaciitapp.com/sebar/dbflex"
 	"github.com/eaciit/toolkit"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Connection struct {
 	dbflex.ConnectionBase `bson:"-" json:"-"`
 	ctx                   context.Context
-	client                *mongo.Client
-	db                    *mongo.Database
+	shared                *sharedClient
+	sharedKey             string
+	session               mongo.Session
+
+	//-- a transaction keeps the client its session was started on until
+	//-- release is called
+	client  *mongo.Client
+	release func()
+
+	//-- mongomem connections keep their data in mem instead of a server
+	inMemory bool
+	mem      *memServer
 }
 
+// Connect takes the client shared by connections with the same server info,
+// creating it if this is the first one. A mongomem connection takes the in
+// memory server named by its host instead.
 func (c *Connection) Connect() error {
-	connURI := "mongodb://"
-	connURI += c.Host + "/"
-
-	opts := options.Client().ApplyURI(connURI)
-	//opts.SetConnectTimeout(5 * time.Second)
-	//opts.SetSocketTimeout(3 * time.Second)
-	//opts.SetServerSelectionTimeout(3 * time.Second)
-	if c.User != "" {
-		opts.SetAuth(options.Credential{
-			Username:   c.User,
-			Password:   c.Password,
-			AuthSource: "admin",
-		})
-	}
-
-	for k, v := range c.Config {
-		klow := strings.ToLower(k)
-		switch klow {
-		case "serverselectiontimeout":
-			opts.SetServerSelectionTimeout(
-				time.Duration(toolkit.ToInt(v, toolkit.RoundingAuto)) * time.Millisecond)
-		}
-	}
-
-	//toolkit.Logger().Debugf("opts: %s", toolkit.JsonString(opts))
-	client, err := mongo.NewClient(opts)
+	if c.shared != nil || c.mem != nil {
+		c.Close()
+	}
+	if c.inMemory {
+		c.mem = memServerOf(c.Host)
+		return nil
+	}
+
+	opts, err := c.ClientOptions()
 	if err != nil {
 		return err
 	}
-
-	//toolkit.Logger().Debug("client generated: OK")
-	if c.ctx == nil {
-		c.ctx = context.Background()
+	policy, err := c.healthPolicy()
+	if err != nil {
+		return err
 	}
 
-	//toolkit.Logger().Debug("context generated: OK")
-	if err = client.Connect(c.ctx); err != nil {
+	key := c.clientKey()
+	shared, err := acquireClient(c.Context(), key, opts, policy)
+	if err != nil {
 		return err
 	}
 
-	//toolkit.Logger().Debug("client connected: OK")
-	if err = client.Ping(c.ctx, nil); err != nil {
-		return err
+	c.shared = shared
+	c.sharedKey = key
+	return nil
+}
+
+// SetContext attach ctx to the connection. It is used by every call that
+// is not given its own context through KeyContext
+func (c *Connection) SetContext(ctx context.Context) *Connection {
+	c.ctx = ctx
+	return c
+}
+
+// Context returns the context attached to the connection
+func (c *Connection) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
 	}
+	return c.ctx
+}
 
-	c.client = client
-	if c.Database != "" {
-		c.db = c.client.Database(c.Database)
+// Client returns the mongo.Client used by the connection, it may be shared with
+// other connections
+func (c *Connection) Client() *mongo.Client {
+	if c.shared == nil {
+		return nil
 	}
+	if c.client != nil {
+		return c.client
+	}
+	return c.shared.current()
+}
 
-	return nil
+// useClient returns the client of c counted as used until done is called,
+// so a reconnect does not disconnect it meanwhile
+func (c *Connection) useClient() (client *mongo.Client, done func()) {
+	if c.shared == nil || c.client != nil {
+		return c.Client(), func() {}
+	}
+	return c.shared.use()
 }
 
+// Mdb returns the database of the server info, it is nil when the server
+// info has no database
 func (c *Connection) Mdb() *mongo.Database {
-	return c.db
+	client := c.Client()
+	if client == nil || c.Database == "" {
+		return nil
+	}
+	return client.Database(c.Database)
+}
+
+// Table returns the database and collection name of tablename. A name
+// written as database:collection, like "audit:events", addresses another
+// database of the cluster, the ":" can not be part of a collection name. A
+// dotted name like "audit.events" is not split, it is the collection
+// audit.events of the server info database, as GridFS uses fs.files. When
+// database is not empty it is used and tablename is taken as is.
+//
+// Every call taking a table name reads it this way: queries, DropTable,
+// ValidateTable, the index calls and the pattern of ListObjects. So the
+// server info needs no database when all names carry theirs.
+func (c *Connection) Table(tablename, database string) (*mongo.Database, string, error) {
+	return c.table(c.Client(), tablename, database)
+}
+
+func (c *Connection) table(client *mongo.Client, tablename, database string) (*mongo.Database, string, error) {
+	if c.inMemory {
+		return nil, "", toolkit.Errorf("a mongomem connection has no driver database")
+	}
+	database, tablename = c.splitTable(tablename, database)
+	if database == "" {
+		return nil, "", toolkit.Errorf("no database selected for %s", tablename)
+	}
+
+	if client == nil {
+		return nil, "", toolkit.Errorf("connection is not connected")
+	}
+	return client.Database(database), tablename, nil
 }
 
+// State reports the health of the deployment: connected, degraded when only
+// part of it is available, or disconnected. It is based on the topology seen
+// by the driver and on a ping whose result is cached for healthCheckInterval.
 func (c *Connection) State() string {
-	if c.client == nil {
-		return dbflex.StateUnknown
-	} else {
+	if c.mem != nil {
 		return dbflex.StateConnected
 	}
+	if c.shared == nil {
+		return dbflex.StateUnknown
+	}
+	return c.shared.state(c.Context())
 }
 
 func (c *Connection) Close() {
-	if c.client != nil {
-		c.client.Disconnect(c.ctx)
-		c.client = nil
+	c.mem = nil
+	c.endSession()
+	if c.shared != nil {
+		releaseClient(c.sharedKey)
+		c.shared = nil
 	}
 }
 
@@ -99,8 +163,31 @@ func (c *Connection) NewQuery() dbflex.IQuery {
 	return q
 }
 
+// splitTable returns the database and collection name of tablename without
+// checking them, see Table
+func (c *Connection) splitTable(tablename, database string) (string, string) {
+	if database != "" {
+		return database, tablename
+	}
+	if i := strings.Index(tablename, ":"); i > 0 {
+		return tablename[:i], tablename[i+1:]
+	}
+	return c.Database, tablename
+}
+
+// DropTable drops the collection name, it may be written as
+// database:collection
 func (c *Connection) DropTable(name string) error {
-	return c.db.Collection(name).Drop(c.ctx)
+	if c.mem != nil {
+		database, name := c.splitTable(name, "")
+		return c.mem.drop(database, name)
+	}
+
+	db, name, err := c.Table(name, "")
+	if err != nil {
+		return err
+	}
+	return db.Collection(name).Drop(c.Context())
 }
 
 /*
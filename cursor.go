@@ -1,9 +1,11 @@
 package flexmgo
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"reflect"
+	"time"
 
 	"git.eaciitapp.com/sebar/dbflex"
 	"github.com/eaciit/toolkit"
@@ -12,41 +14,82 @@ import (
 
 type Cursor struct {
 	dbflex.CursorBase
-	mc *mongo.Cursor
 
 	tablename string
 	countParm toolkit.M
 	conn      *Connection
+	coll      collection
 	cursor    *mongo.Cursor
+	ctx       context.Context
+	//-- done releases the client of the cursor, see sharedClient.use
+	done func()
 }
 
+// closeTimeout bounds the killCursors sent by Close
+const closeTimeout = 5 * time.Second
+
+// Close releases the server cursor. It does not use the context of the query,
+// which may be done by then and would leave the cursor open on the server.
 func (cr *Cursor) Close() {
-	if cr.mc != nil {
-		cr.mc.Close(cr.conn.ctx)
+	if cr.cursor != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+		defer cancel()
+		cr.cursor.Close(ctx)
+	}
+	if cr.done != nil {
+		cr.done()
 	}
 }
 
 func (cr *Cursor) Count() int {
-	sr := cr.conn.db.RunCommand(cr.conn.ctx, cr.countParm)
-	if sr.Err() != nil {
-		dbflex.Logger().Errorf("unablet to get count. %s", sr.Err().Error())
+	span := cr.startSpan("count")
+	n, err := cr.count()
+	endSpan(span, err)
+	if err != nil {
+		dbflex.Logger().Errorf("unable to get count. %s", err.Error())
 		return -1
 	}
+	return n
+}
 
-	countModel := new(struct{ N int })
-	if err := sr.Decode(countModel); err != nil {
-		dbflex.Logger().Errorf("unablet to decode count. %s", sr.Err().Error())
-		return -1
+func (cr *Cursor) count() (int, error) {
+	if cr.Error() != nil {
+		return 0, cr.Error()
+	}
+
+	if cr.countParm == nil {
+		return 0, toolkit.Errorf("count is not available for a command or geoNear cursor")
 	}
-	return countModel.N
+	where, _ := cr.countParm.Get("query").(toolkit.M)
+	if where == nil {
+		where = toolkit.M{}
+	}
+
+	var (
+		n   int64
+		err error
+	)
+	if cr.conn.InTransaction() {
+		//-- count command is not allowed in a transaction
+		n, err = cr.coll.CountDocuments(cr.ctx, where)
+	} else {
+		n, err = cr.coll.Count(cr.ctx, where)
+	}
+	return int(n), err
 }
 
-func (cr *Cursor) Fetch(out interface{}) error {
+func (cr *Cursor) Fetch(out interface{}) (err error) {
+	span := cr.startSpan("fetch")
+	defer func() { endSpan(span, err) }()
+
 	if cr.Error() != nil {
-		return toolkit.Errorf("unable to fetch data. %s", cr.Error())
+		return wrapError(cr.Error(), "unable to fetch data. %s", cr.Error())
 	}
 
-	if neof := cr.cursor.Next(cr.conn.ctx); !neof {
+	if neof := cr.cursor.Next(cr.ctx); !neof {
+		if err := cr.cursor.Err(); err != nil {
+			return wrapError(err, "unable to fetch data. %s", err.Error())
+		}
 		return io.EOF
 	}
 
@@ -57,9 +100,12 @@ func (cr *Cursor) Fetch(out interface{}) error {
 	return nil
 }
 
-func (cr *Cursor) Fetchs(result interface{}, n int) error {
+func (cr *Cursor) Fetchs(result interface{}, n int) (err error) {
+	span := cr.startSpan("fetchs")
+	defer func() { endSpan(span, err) }()
+
 	if cr.Error() != nil {
-		return toolkit.Errorf("unable to fetch data. %s", cr.Error())
+		return wrapError(cr.Error(), "unable to fetch data. %s", cr.Error())
 	}
 
 	v := reflect.TypeOf(result).Elem().Elem()
@@ -67,7 +113,10 @@ func (cr *Cursor) Fetchs(result interface{}, n int) error {
 
 	read := 0
 	for {
-		if !cr.cursor.Next(cr.conn.ctx) {
+		if !cr.cursor.Next(cr.ctx) {
+			if err := cr.cursor.Err(); err != nil {
+				return wrapError(err, "unable to fetch data. %s", err.Error())
+			}
 			break
 		}
 
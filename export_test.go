@@ -0,0 +1,13 @@
+package flexmgo
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// HealthState is the state of client seen by a health monitor that has not
+// had a topology event yet
+func HealthState(client *mongo.Client) string {
+	return new(healthMonitor).state(context.Background(), client, 0)
+}
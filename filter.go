@@ -0,0 +1,434 @@
+package flexmgo
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+
+	df "git.eaciitapp.com/sebar/dbflex"
+	"github.com/eaciit/toolkit"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// OpContainsCase, OpStartWithCase and OpEndWithCase are the case
+	// sensitive versions of the dbflex Contains, StartWith and EndWith
+	OpContainsCase  df.FilterOp = "$containscase"
+	OpStartWithCase df.FilterOp = "$startwithcase"
+	OpEndWithCase   df.FilterOp = "$endwithcase"
+	// OpRegex matches a field with a regular expression used as is
+	OpRegex df.FilterOp = "$regex"
+
+	OpExists    df.FilterOp = "$exists"
+	OpType      df.FilterOp = "$type"
+	OpSize      df.FilterOp = "$size"
+	OpAll       df.FilterOp = "$all"
+	OpElemMatch df.FilterOp = "$elemMatch"
+	OpMod       df.FilterOp = "$mod"
+	OpIsNull    df.FilterOp = "$isnull"
+	OpIsNotNull df.FilterOp = "$isnotnull"
+)
+
+// regexOptions are the $options a Regex filter may have
+const regexOptions = "imsx"
+
+// bsonTypes are the aliases and numbers of the BSON types of Type, they are
+// also used by mongomem to evaluate $type
+var bsonTypes = map[string]int{
+	"double": 1, "string": 2, "object": 3, "array": 4, "binData": 5,
+	"undefined": 6, "objectId": 7, "bool": 8, "date": 9, "null": 10,
+	"regex": 11, "javascript": 13, "symbol": 14, "int": 16,
+	"timestamp": 17, "long": 18, "decimal": 19, "minKey": -1, "maxKey": 127,
+}
+
+// ContainsCase matches field containing any of values, with their case
+func ContainsCase(field string, values ...string) *df.Filter {
+	return df.NewFilter(field, OpContainsCase, values, nil)
+}
+
+// StartWithCase matches field starting with value, with its case. Unlike a
+// case insensitive one it can use an index on field.
+func StartWithCase(field string, value string) *df.Filter {
+	return df.NewFilter(field, OpStartWithCase, value, nil)
+}
+
+// EndWithCase matches field ending with value, with its case
+func EndWithCase(field string, value string) *df.Filter {
+	return df.NewFilter(field, OpEndWithCase, value, nil)
+}
+
+// Regex matches field with the regular expression pattern. Unlike the value
+// of Contains, pattern is not escaped. options are the $regex options, some
+// of i, m, s and x.
+func Regex(field string, pattern string, options string) *df.Filter {
+	return df.NewFilter(field, OpRegex, primitive.Regex{Pattern: pattern, Options: options}, nil)
+}
+
+// Exists matches documents having field, or not having it when exists is
+// false. A field set to null exists.
+func Exists(field string, exists bool) *df.Filter {
+	return df.NewFilter(field, OpExists, exists, nil)
+}
+
+// Type matches field having one of the BSON types, given by alias like
+// string, int, double, array or number for any numeric type
+func Type(field string, types ...string) *df.Filter {
+	return df.NewFilter(field, OpType, types, nil)
+}
+
+// Size matches the arrays field having n items
+func Size(field string, n int) *df.Filter {
+	return df.NewFilter(field, OpSize, n, nil)
+}
+
+// All matches the arrays field having all of values
+func All(field string, values ...interface{}) *df.Filter {
+	return df.NewFilter(field, OpAll, values, nil)
+}
+
+// ElemMatch matches the arrays field having an item matching all of
+// filters. For an array of documents the filters are on the fields of the
+// items, for an array of values they are on the item itself and have an
+// empty field, like ElemMatch("scores", Gte("", 80), Lt("", 90)).
+func ElemMatch(field string, filters ...*df.Filter) *df.Filter {
+	return df.NewFilter(field, OpElemMatch, nil, filters)
+}
+
+// Mod matches the numbers field whose remainder of the division by divisor
+// is remainder
+func Mod(field string, divisor, remainder int64) *df.Filter {
+	return df.NewFilter(field, OpMod, []int64{divisor, remainder}, nil)
+}
+
+// IsNull matches field being null or missing
+func IsNull(field string) *df.Filter {
+	return df.NewFilter(field, OpIsNull, nil, nil)
+}
+
+// IsNotNull matches field being set to something else than null
+func IsNotNull(field string) *df.Filter {
+	return df.NewFilter(field, OpIsNotNull, nil, nil)
+}
+
+// regexCondition is the $regex condition of pattern, case insensitive when
+// insensitive is set
+func regexCondition(pattern string, insensitive bool) toolkit.M {
+	cond := toolkit.M{}.Set("$regex", pattern)
+	if insensitive {
+		cond.Set("$options", "i")
+	}
+	return cond
+}
+
+// regexFilter builds the filter of the Contains, StartWith and EndWith ops
+// and of their case sensitive versions. Values are literal text, they are
+// escaped so a dot or a bracket is not read as part of a regex.
+func regexFilter(f *df.Filter) (toolkit.M, error) {
+	insensitive := f.Op == df.OpContains || f.Op == df.OpStartWith || f.Op == df.OpEndWith
+
+	switch f.Op {
+	case df.OpContains, OpContainsCase:
+		values := f.Value.([]string)
+		if len(values) == 1 {
+			return toolkit.M{}.Set(f.Field, regexCondition(regexp.QuoteMeta(values[0]), insensitive)), nil
+		}
+
+		items := []interface{}{}
+		for _, v := range values {
+			items = append(items, toolkit.M{}.Set(f.Field, regexCondition(regexp.QuoteMeta(v), insensitive)))
+		}
+		return toolkit.M{}.Set("$or", items), nil
+
+	case df.OpStartWith, OpStartWithCase:
+		//-- without a trailing .* a case sensitive prefix can use an index
+		return toolkit.M{}.Set(f.Field, regexCondition("^"+regexp.QuoteMeta(toolkit.ToString(f.Value)), insensitive)), nil
+
+	case df.OpEndWith, OpEndWithCase:
+		return toolkit.M{}.Set(f.Field, regexCondition(regexp.QuoteMeta(toolkit.ToString(f.Value))+"$", insensitive)), nil
+	}
+
+	var re primitive.Regex
+	switch v := f.Value.(type) {
+	case primitive.Regex:
+		re = v
+	case string:
+		re.Pattern = v
+	default:
+		return nil, toolkit.Errorf("%s on %s needs a string pattern, got %T", f.Op, f.Field, f.Value)
+	}
+	for _, o := range re.Options {
+		if !strings.ContainsRune(regexOptions, o) {
+			return nil, toolkit.Errorf("invalid regex option %c on %s", o, f.Field)
+		}
+	}
+	cond := toolkit.M{}.Set("$regex", re.Pattern)
+	if re.Options != "" {
+		cond.Set("$options", re.Options)
+	}
+	return toolkit.M{}.Set(f.Field, cond), nil
+}
+
+// unnegatable are the ops the server can not have in a $not or a $nor
+var unnegatable = map[df.FilterOp]bool{
+	OpText:       true,
+	OpNear:       true,
+	OpNearSphere: true,
+}
+
+// notFilter builds the negation of the filter in f.Items. A field condition
+// is wrapped in $not, an Or becomes a $nor of its items and an And becomes,
+// by De Morgan, an Or of its negated items. Anything else goes in a $nor.
+func (q *Query) notFilter(f *df.Filter) (interface{}, error) {
+	if len(f.Items) == 0 || f.Items[0] == nil {
+		return nil, toolkit.Errorf("%s needs a filter to negate", f.Op)
+	}
+	inner := f.Items[0]
+
+	if err := checkFilter(inner); err != nil {
+		return nil, err
+	}
+	if err := checkNegatable(inner); err != nil {
+		return nil, err
+	}
+	if inner.Op == df.OpRange {
+		values := inner.Value.([]interface{})
+		inner = df.And(df.Gte(inner.Field, values[0]), df.Lte(inner.Field, values[1]))
+	}
+
+	switch inner.Op {
+	case df.OpNot:
+		//-- not of not is the filter itself
+		if len(inner.Items) == 0 || inner.Items[0] == nil {
+			return nil, toolkit.Errorf("%s needs a filter to negate", inner.Op)
+		}
+		return q.BuildFilter(inner.Items[0])
+
+	case df.OpAnd:
+		items := make([]*df.Filter, len(inner.Items))
+		for i, item := range inner.Items {
+			items[i] = df.Not(item)
+		}
+		return q.BuildFilter(df.Or(items...))
+	}
+
+	bf, err := q.BuildFilter(inner)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := bf.(toolkit.M); ok && len(m) == 1 {
+		for k, v := range m {
+			if k == "$or" {
+				return toolkit.M{}.Set("$nor", v), nil
+			}
+			if cond, ok := v.(toolkit.M); ok && !strings.HasPrefix(k, "$") && isOperators(cond) {
+				return toolkit.M{}.Set(k, toolkit.M{}.Set("$not", cond)), nil
+			}
+		}
+	}
+	return toolkit.M{}.Set("$nor", []interface{}{bf}), nil
+}
+
+// checkNegatable returns an error if f or one of its items is an op that can
+// not be negated
+func checkNegatable(f *df.Filter) error {
+	if unnegatable[f.Op] {
+		return toolkit.Errorf("%s can not be negated", f.Op)
+	}
+	for _, item := range f.Items {
+		if item == nil {
+			continue
+		}
+		if err := checkNegatable(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isOperators tells if every key of cond is a query operator
+func isOperators(cond toolkit.M) bool {
+	if len(cond) == 0 {
+		return false
+	}
+	for k := range cond {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// checkFilter validates the value of f before it is built, so a wrong value
+// is an error instead of a panic
+func checkFilter(f *df.Filter) error {
+	if f == nil {
+		return toolkit.Errorf("filter is nil")
+	}
+
+	switch f.Op {
+	case df.OpRange:
+		if values, ok := f.Value.([]interface{}); !ok || len(values) != 2 {
+			return toolkit.Errorf("%s on %s needs a from and a to value, got %v", f.Op, f.Field, f.Value)
+		}
+
+	case df.OpContains, OpContainsCase:
+		if values, ok := f.Value.([]string); !ok || len(values) == 0 {
+			return toolkit.Errorf("%s on %s needs at least one string value, got %v", f.Op, f.Field, f.Value)
+		}
+
+	case df.OpIn, df.OpNin:
+		if f.Value == nil {
+			return toolkit.Errorf("%s on %s needs a list of values", f.Op, f.Field)
+		}
+		if k := reflect.TypeOf(f.Value).Kind(); k != reflect.Slice && k != reflect.Array {
+			return toolkit.Errorf("%s on %s needs a list of values, got %T", f.Op, f.Field, f.Value)
+		}
+
+	case df.OpAnd, df.OpOr, OpElemMatch:
+		if len(f.Items) == 0 {
+			return toolkit.Errorf("%s needs at least one filter", f.Op)
+		}
+
+	case OpExists:
+		if _, ok := f.Value.(bool); !ok {
+			return toolkit.Errorf("%s on %s needs a bool, got %T", f.Op, f.Field, f.Value)
+		}
+
+	case OpType:
+		types, ok := f.Value.([]string)
+		if !ok || len(types) == 0 {
+			return toolkit.Errorf("%s on %s needs at least one type", f.Op, f.Field)
+		}
+		for _, t := range types {
+			if _, ok := bsonTypes[t]; !ok && t != "number" {
+				return toolkit.Errorf("%s on %s has an unknown type %s", f.Op, f.Field, t)
+			}
+		}
+
+	case OpSize:
+		if n, ok := f.Value.(int); !ok || n < 0 {
+			return toolkit.Errorf("%s on %s needs a size of 0 or more, got %v", f.Op, f.Field, f.Value)
+		}
+
+	case OpAll:
+		if values, ok := f.Value.([]interface{}); !ok || len(values) == 0 {
+			return toolkit.Errorf("%s on %s needs at least one value", f.Op, f.Field)
+		}
+
+	case OpNear, OpNearSphere, OpGeoWithin, OpGeoIntersects:
+		return checkGeo(f)
+
+	case OpText:
+		return checkText(f)
+
+	case OpMod:
+		if values, ok := f.Value.([]int64); !ok || len(values) != 2 || values[0] == 0 {
+			return toolkit.Errorf("%s on %s needs a divisor other than 0 and a remainder, got %v", f.Op, f.Field, f.Value)
+		}
+	}
+	return nil
+}
+
+// operatorFilter builds the filter of the ops matching a field by its type,
+// its existence or its array items
+func (q *Query) operatorFilter(f *df.Filter) (interface{}, error) {
+	var cond toolkit.M
+	switch f.Op {
+	case OpExists:
+		cond = toolkit.M{}.Set("$exists", f.Value)
+
+	case OpType:
+		types := f.Value.([]string)
+		if len(types) == 1 {
+			cond = toolkit.M{}.Set("$type", types[0])
+		} else {
+			cond = toolkit.M{}.Set("$type", types)
+		}
+
+	case OpSize, OpAll, OpMod:
+		cond = toolkit.M{}.Set(string(f.Op), f.Value)
+
+	case OpIsNull:
+		//-- null equality matches a missing field too
+		cond = toolkit.M{}.Set("$eq", nil)
+
+	case OpIsNotNull:
+		cond = toolkit.M{}.Set("$ne", nil)
+
+	case OpElemMatch:
+		match, err := q.elemMatch(f)
+		if err != nil {
+			return nil, err
+		}
+		cond = toolkit.M{}.Set("$elemMatch", match)
+	}
+	return toolkit.M{}.Set(f.Field, cond), nil
+}
+
+// elemMatch builds the condition on an array item of ElemMatch. Filters with
+// an empty field are on the item itself, the others on its fields.
+func (q *Query) elemMatch(f *df.Filter) (toolkit.M, error) {
+	item := toolkit.M{}
+	fields := []interface{}{}
+	for _, sub := range f.Items {
+		bf, err := q.BuildFilter(sub)
+		if err != nil {
+			return nil, toolkit.Errorf("unable to build %s filter. %s: %s", f.Op, filterName(sub), err.Error())
+		}
+
+		m := bf.(toolkit.M)
+		if cond, ok := m[""].(toolkit.M); ok && len(m) == 1 {
+			for k, v := range cond {
+				item.Set(k, v)
+			}
+			continue
+		}
+		for k := range m {
+			if k == "" {
+				return nil, toolkit.Errorf("%s on %s can not have %s on the item itself", f.Op, f.Field, filterName(sub))
+			}
+		}
+		fields = append(fields, m)
+	}
+
+	switch {
+	case len(item) > 0 && len(fields) > 0:
+		return nil, toolkit.Errorf("%s on %s has filters on both the item and its fields", f.Op, f.Field)
+	case len(item) > 0:
+		return item, nil
+	case len(fields) == 1:
+		return fields[0].(toolkit.M), nil
+	}
+	return toolkit.M{}.Set("$and", fields), nil
+}
+
+// itemsFilter builds the filters of an And or an Or. Every item has to be
+// built, leaving out one that fails would widen an And or narrow an Or, so
+// the errors of all of them are returned together.
+func (q *Query) itemsFilter(f *df.Filter) (interface{}, error) {
+	items := []interface{}{}
+	errs := []string{}
+	for _, item := range f.Items {
+		bf, err := q.BuildFilter(item)
+		if err != nil {
+			errs = append(errs, filterName(item)+": "+err.Error())
+			continue
+		}
+		items = append(items, bf)
+	}
+	if len(errs) > 0 {
+		return nil, toolkit.Errorf("unable to build %s filter. %s", f.Op, strings.Join(errs, "; "))
+	}
+	return toolkit.M{}.Set(string(f.Op), items), nil
+}
+
+// filterName names f by its op, and its field if it has one
+func filterName(f *df.Filter) string {
+	if f == nil {
+		return "nil"
+	}
+	if f.Field == "" {
+		return string(f.Op)
+	}
+	return string(f.Op) + " on " + f.Field
+}
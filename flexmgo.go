@@ -2,6 +2,19 @@ package flexmgo
 
 import "git.eaciitapp.com/sebar/dbflex"
 
+const (
+	// KeyContext is the key of a context.Context in the toolkit.M given to
+	// Cursor and Execute. It overrides the connection context for that call.
+	KeyContext = "context"
+
+	// KeyDatabase is the key of the database of a query, in the toolkit.M
+	// given to Cursor and Execute or in the query config. The table name is
+	// then used as is. Without it a table name may be written as
+	// database:collection, From("audit:events") for instance, see
+	// Connection.Table.
+	KeyDatabase = "database"
+)
+
 func init() {
 	dbflex.RegisterDriver("mongodb", func(si *dbflex.ServerInfo) dbflex.IConnection {
 		c := new(Connection)
@@ -9,4 +22,12 @@ func init() {
 		c.SetThis(c)
 		return c
 	})
+
+	dbflex.RegisterDriver("mongomem", func(si *dbflex.ServerInfo) dbflex.IConnection {
+		c := new(Connection)
+		c.ServerInfo = *si
+		c.inMemory = true
+		c.SetThis(c)
+		return c
+	})
 }
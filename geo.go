@@ -0,0 +1,296 @@
+package flexmgo
+
+import (
+	"math"
+
+	df "git.eaciitapp.com/sebar/dbflex"
+	"github.com/eaciit/toolkit"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	OpNear          df.FilterOp = "$near"
+	OpNearSphere    df.FilterOp = "$nearSphere"
+	OpGeoWithin     df.FilterOp = "$geoWithin"
+	OpGeoIntersects df.FilterOp = "$geoIntersects"
+)
+
+// KeyGeoNear is the cursor parameter, or query config, key of the GeoNear
+// stage of a cursor
+const KeyGeoNear = "geoNear"
+
+// earthRadius is the radius, in meters, a $centerSphere distance is divided
+// by to get radians
+const earthRadius = 6378100.0
+
+// Point is a position given as longitude and latitude, in degrees
+type Point struct {
+	Lng float64
+	Lat float64
+}
+
+func (p Point) coordinates() []float64 {
+	return []float64{p.Lng, p.Lat}
+}
+
+func (p Point) valid() bool {
+	return p.Lng >= -180 && p.Lng <= 180 && p.Lat >= -90 && p.Lat <= 90
+}
+
+// Geometry is a GeoJSON geometry, it can be the type of a model field as
+// well as the shape of a GeoIntersects filter
+type Geometry struct {
+	Type        string      `bson:"type" json:"type"`
+	Coordinates interface{} `bson:"coordinates" json:"coordinates"`
+}
+
+// PointGeometry is the GeoJSON Point of p
+func PointGeometry(p Point) Geometry {
+	return Geometry{Type: "Point", Coordinates: p.coordinates()}
+}
+
+// LineGeometry is the GeoJSON LineString going through points
+func LineGeometry(points ...Point) Geometry {
+	coords := [][]float64{}
+	for _, p := range points {
+		coords = append(coords, p.coordinates())
+	}
+	return Geometry{Type: "LineString", Coordinates: coords}
+}
+
+// PolygonGeometry is the GeoJSON Polygon with points as its outer ring. The
+// ring is closed if its last point is not its first one.
+func PolygonGeometry(points ...Point) Geometry {
+	ring := [][]float64{}
+	for _, p := range points {
+		ring = append(ring, p.coordinates())
+	}
+	if len(points) > 0 && points[0] != points[len(points)-1] {
+		ring = append(ring, points[0].coordinates())
+	}
+	return Geometry{Type: "Polygon", Coordinates: [][][]float64{ring}}
+}
+
+// nearQuery is the value of the near filters
+type nearQuery struct {
+	point    Point
+	min, max float64
+}
+
+// withinQuery is the value of the GeoWithin filters, shape is the $geoWithin
+// operator: $box, $geometry or $centerSphere
+type withinQuery struct {
+	shape  string
+	points []Point
+	radius float64
+}
+
+// Near matches documents with a GeoJSON field near the point lng, lat,
+// sorted from the nearest. Distances are in meters, a zero one is not used.
+// field needs a 2dsphere index, see EnsureGeoIndexes.
+func Near(field string, lng, lat, minDistance, maxDistance float64) *df.Filter {
+	return df.NewFilter(field, OpNear, nearQuery{Point{lng, lat}, minDistance, maxDistance}, nil)
+}
+
+// NearSphere is Near with distances computed on a sphere, which is what
+// Near does already for a GeoJSON point
+func NearSphere(field string, lng, lat, minDistance, maxDistance float64) *df.Filter {
+	return df.NewFilter(field, OpNearSphere, nearQuery{Point{lng, lat}, minDistance, maxDistance}, nil)
+}
+
+// GeoWithinBox matches field within the rectangle from its bottom left to
+// its top right corner, on a flat plane
+func GeoWithinBox(field string, bottomLeft, topRight Point) *df.Filter {
+	return df.NewFilter(field, OpGeoWithin, withinQuery{shape: "$box", points: []Point{bottomLeft, topRight}}, nil)
+}
+
+// GeoWithinPolygon matches field within the polygon whose outer ring goes
+// through points
+func GeoWithinPolygon(field string, points ...Point) *df.Filter {
+	return df.NewFilter(field, OpGeoWithin, withinQuery{shape: "$geometry", points: points}, nil)
+}
+
+// GeoWithinCenterSphere matches field within radius meters of center
+func GeoWithinCenterSphere(field string, center Point, radius float64) *df.Filter {
+	return df.NewFilter(field, OpGeoWithin, withinQuery{shape: "$centerSphere", points: []Point{center}, radius: radius}, nil)
+}
+
+// GeoIntersects matches field intersecting geometry
+func GeoIntersects(field string, geometry Geometry) *df.Filter {
+	return df.NewFilter(field, OpGeoIntersects, geometry, nil)
+}
+
+// checkGeo validates the value of a geo filter
+func checkGeo(f *df.Filter) error {
+	switch v := f.Value.(type) {
+	case nearQuery:
+		if !v.point.valid() {
+			return toolkit.Errorf("%s on %s has an invalid point %v", f.Op, f.Field, v.point)
+		}
+		if v.min < 0 || v.max < 0 || math.IsNaN(v.min) || math.IsNaN(v.max) || (v.max > 0 && v.min > v.max) {
+			return toolkit.Errorf("%s on %s has invalid distances %v to %v", f.Op, f.Field, v.min, v.max)
+		}
+
+	case withinQuery:
+		for _, p := range v.points {
+			if !p.valid() {
+				return toolkit.Errorf("%s on %s has an invalid point %v", f.Op, f.Field, p)
+			}
+		}
+		distinct := map[Point]bool{}
+		for _, p := range v.points {
+			distinct[p] = true
+		}
+		if v.shape == "$geometry" && len(distinct) < 3 {
+			return toolkit.Errorf("%s on %s needs a polygon of 3 points or more", f.Op, f.Field)
+		}
+		if v.shape == "$centerSphere" && v.radius <= 0 {
+			return toolkit.Errorf("%s on %s needs a positive radius", f.Op, f.Field)
+		}
+
+	case Geometry:
+		switch v.Type {
+		case "Point", "LineString", "Polygon", "MultiPoint", "MultiLineString", "MultiPolygon", "GeometryCollection":
+		default:
+			return toolkit.Errorf("%s on %s has an unknown geometry type %s", f.Op, f.Field, v.Type)
+		}
+
+	default:
+		return toolkit.Errorf("%s on %s has an invalid value %T", f.Op, f.Field, f.Value)
+	}
+	return nil
+}
+
+// geoFilter builds the filter of the geo ops
+func geoFilter(f *df.Filter) (interface{}, error) {
+	var cond toolkit.M
+	switch v := f.Value.(type) {
+	case nearQuery:
+		near := toolkit.M{}.Set("$geometry", PointGeometry(v.point))
+		if v.min > 0 {
+			near.Set("$minDistance", v.min)
+		}
+		if v.max > 0 {
+			near.Set("$maxDistance", v.max)
+		}
+		cond = toolkit.M{}.Set(string(f.Op), near)
+
+	case withinQuery:
+		var shape interface{}
+		switch v.shape {
+		case "$box":
+			shape = [][]float64{v.points[0].coordinates(), v.points[1].coordinates()}
+		case "$geometry":
+			shape = PolygonGeometry(v.points...)
+		case "$centerSphere":
+			shape = []interface{}{v.points[0].coordinates(), v.radius / earthRadius}
+		}
+		cond = toolkit.M{}.Set(string(f.Op), toolkit.M{}.Set(v.shape, shape))
+
+	case Geometry:
+		cond = toolkit.M{}.Set(string(f.Op), toolkit.M{}.Set("$geometry", v))
+	}
+	return toolkit.M{}.Set(f.Field, cond), nil
+}
+
+// GeoNear is the $geoNear stage a cursor runs when it is given under
+// KeyGeoNear. Documents come with their distance in meters written in
+// DistanceField, sorted from the nearest to Near unless the command has an
+// order. The where clause, the order, the skip, the take and the selected
+// fields of the command still apply.
+type GeoNear struct {
+	Near Point
+	// DistanceField is the field the distance is written to, default
+	// "distance"
+	DistanceField string
+	// MinDistance and MaxDistance limit the distance in meters, a zero one is
+	// not used
+	MinDistance float64
+	MaxDistance float64
+	// Key is the field of the 2dsphere index, needed when the collection has
+	// more than one
+	Key string
+}
+
+// geoNearPipeline builds the pipeline of a GeoNear cursor
+func geoNearPipeline(v interface{}, where toolkit.M, parts df.GroupedQueryItems) ([]toolkit.M, error) {
+	var gn GeoNear
+	switch x := v.(type) {
+	case GeoNear:
+		gn = x
+	case *GeoNear:
+		gn = *x
+	default:
+		return nil, toolkit.Errorf("invalid %s %T, it should be a GeoNear", KeyGeoNear, v)
+	}
+	if !gn.Near.valid() {
+		return nil, toolkit.Errorf("invalid %s point %v", KeyGeoNear, gn.Near)
+	}
+	if gn.MinDistance < 0 || gn.MaxDistance < 0 || math.IsNaN(gn.MinDistance) || math.IsNaN(gn.MaxDistance) {
+		return nil, toolkit.Errorf("invalid %s distances %v to %v", KeyGeoNear, gn.MinDistance, gn.MaxDistance)
+	}
+	if gn.DistanceField == "" {
+		gn.DistanceField = "distance"
+	}
+
+	stage := toolkit.M{}.
+		Set("near", PointGeometry(gn.Near)).
+		Set("distanceField", gn.DistanceField).
+		Set("spherical", true)
+	if len(where) > 0 {
+		stage.Set("query", where)
+	}
+	if gn.MinDistance > 0 {
+		stage.Set("minDistance", gn.MinDistance)
+	}
+	if gn.MaxDistance > 0 {
+		stage.Set("maxDistance", gn.MaxDistance)
+	}
+	if gn.Key != "" {
+		stage.Set("key", gn.Key)
+	}
+
+	pipes := []toolkit.M{toolkit.M{}.Set("$geoNear", stage)}
+	if items, ok := parts[df.QueryOrder]; ok {
+		sort, err := sortDoc(items[0].Value.([]string))
+		if err != nil {
+			return nil, err
+		}
+		if len(sort) > 0 {
+			pipes = append(pipes, toolkit.M{}.Set("$sort", sort))
+		}
+	}
+	if items, ok := parts[df.QuerySkip]; ok {
+		pipes = append(pipes, toolkit.M{}.Set("$skip", items[0].Value))
+	}
+	if items, ok := parts[df.QueryTake]; ok {
+		pipes = append(pipes, toolkit.M{}.Set("$limit", items[0].Value))
+	}
+	if items, ok := parts[df.QuerySelect]; ok {
+		project, err := projectionDoc(items[0].Value.([]string))
+		if err != nil {
+			return nil, err
+		}
+		if len(project) > 0 {
+			//-- an inclusion keeps the distance, an exclusion has it already
+			if inclusion(project) {
+				project = append(project, bson.E{Key: gn.DistanceField, Value: 1})
+			}
+			pipes = append(pipes, toolkit.M{}.Set("$project", project))
+		}
+	}
+	return pipes, nil
+}
+
+// EnsureGeoIndexes makes sure each of fields of tablename has a 2dsphere
+// index, which Near and GeoNear need. See EnsureIndexes.
+func (c *Connection) EnsureGeoIndexes(tablename string, fields ...string) (*IndexReport, error) {
+	if len(fields) == 0 {
+		return nil, toolkit.Errorf("no field to index on %s", tablename)
+	}
+	specs := []IndexSpec{}
+	for _, field := range fields {
+		specs = append(specs, IndexSpec{Keys: bson.D{{Key: field, Value: "2dsphere"}}})
+	}
+	return c.EnsureIndexes(tablename, specs...)
+}
@@ -0,0 +1,154 @@
+package flexmgo
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"git.eaciitapp.com/sebar/dbflex"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/description"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+const (
+	// StateDisconnected means no server of the deployment can be reached
+	StateDisconnected = "Disconnected"
+	// StateDegraded means the deployment is reachable but not fully, for
+	// example it has no primary or some of its members are down
+	StateDegraded = "Degraded"
+
+	pingTimeout = 2 * time.Second
+)
+
+// healthPolicy is read from the connection config keys healthCheckInterval,
+// reconnect, reconnectInterval and reconnectMaxInterval
+type healthPolicy struct {
+	// pingTTL is how long the result of a ping is reused by State
+	pingTTL time.Duration
+	// reconnect rebuilds the client once the deployment is disconnected
+	reconnect bool
+	// minBackoff and maxBackoff bound the wait between reconnect attempts,
+	// the wait doubles after each failed attempt
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+func (c *Connection) healthPolicy() (healthPolicy, error) {
+	p := healthPolicy{
+		pingTTL:    5 * time.Second,
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
+	}
+
+	var err error
+	if v := c.configValue("healthCheckInterval"); v != nil {
+		if p.pingTTL, err = configDuration(v, time.Millisecond); err != nil {
+			return p, err
+		}
+	}
+	if v := c.configValue("reconnect"); v != nil {
+		if p.reconnect, err = configBool(v); err != nil {
+			return p, err
+		}
+	}
+	if v := c.configValue("reconnectInterval"); v != nil {
+		if p.minBackoff, err = configDuration(v, time.Millisecond); err != nil {
+			return p, err
+		}
+	}
+	if v := c.configValue("reconnectMaxInterval"); v != nil {
+		if p.maxBackoff, err = configDuration(v, time.Millisecond); err != nil {
+			return p, err
+		}
+	}
+	if p.maxBackoff < p.minBackoff {
+		p.maxBackoff = p.minBackoff
+	}
+	return p, nil
+}
+
+// healthMonitor keeps the last topology description reported by the SDAM
+// monitor of a client and the result of the last ping
+type healthMonitor struct {
+	mtx      sync.Mutex
+	topology *description.Topology
+	closed   bool
+	pingAt   time.Time
+	pingErr  error
+}
+
+func (h *healthMonitor) serverMonitor() *event.ServerMonitor {
+	return &event.ServerMonitor{
+		TopologyDescriptionChanged: func(e *event.TopologyDescriptionChangedEvent) {
+			h.mtx.Lock()
+			defer h.mtx.Unlock()
+			topology := e.NewDescription
+			h.topology = &topology
+		},
+		TopologyClosed: func(*event.TopologyClosedEvent) {
+			h.mtx.Lock()
+			defer h.mtx.Unlock()
+			h.closed = true
+		},
+	}
+}
+
+// state pings client if the previous ping is older than ttl and combines the
+// ping result with the latest topology description
+func (h *healthMonitor) state(ctx context.Context, client *mongo.Client, ttl time.Duration) string {
+	h.mtx.Lock()
+	needPing := h.pingAt.IsZero() || time.Since(h.pingAt) >= ttl
+	h.mtx.Unlock()
+
+	if needPing {
+		pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+		err := client.Ping(pingCtx, readpref.Nearest())
+		cancel()
+
+		h.mtx.Lock()
+		h.pingAt = time.Now()
+		h.pingErr = err
+		h.mtx.Unlock()
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.closed {
+		return StateDisconnected
+	}
+
+	if h.topology == nil {
+		//-- without a topology event the ping is all there is to go by
+		if h.pingErr != nil {
+			return StateDisconnected
+		}
+		return dbflex.StateConnected
+	}
+	topoState := topologyState(*h.topology)
+	if h.pingErr != nil && topoState == dbflex.StateConnected {
+		return StateDegraded
+	}
+	return topoState
+}
+
+// topologyState is connected when a writable server is available and no
+// member is unknown, degraded when only part of the deployment is available
+func topologyState(t description.Topology) string {
+	available := 0
+	for _, s := range t.Servers {
+		if s.Kind != description.Unknown {
+			available++
+		}
+	}
+
+	switch {
+	case available == 0:
+		return StateDisconnected
+	case t.HasWritableServer() && available == len(t.Servers):
+		return dbflex.StateConnected
+	default:
+		return StateDegraded
+	}
+}
@@ -0,0 +1,564 @@
+package flexmgo
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/eaciit/toolkit"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IndexSpec describes an index of a collection. Keys are in index order,
+// their value is 1 or -1 for ascending or descending, or the index type such
+// as "text", "2dsphere" or "hashed". An empty Name is generated from the keys
+// the same way the server does, for example "age_1_name_-1".
+type IndexSpec struct {
+	Name               string
+	Keys               bson.D
+	Unique             bool
+	Sparse             bool
+	ExpireAfterSeconds *int32
+	PartialFilter      toolkit.M
+	Collation          *options.Collation
+	Weights            toolkit.M
+	DefaultLanguage    string
+}
+
+// Indexer is implemented by models declaring indexes that struct tags can
+// not describe, for example partial indexes
+type Indexer interface {
+	Indexes() []IndexSpec
+}
+
+// IndexReport compares the indexes declared in code with the ones on the
+// server. The _id index is left out.
+type IndexReport struct {
+	Table string
+	// Missing are declared but not on the server, EnsureIndexes creates them
+	Missing []IndexSpec
+	// Extra are on the server but not declared
+	Extra []IndexSpec
+	// Conflicts are declared with a name used on the server by another
+	// definition
+	Conflicts []string
+}
+
+// ModelIndexes returns the indexes declared by obj, from its index struct
+// tags followed by its Indexes method if it implements Indexer.
+//
+// The index tag holds one or more entries separated by ";", each entry is
+// an optional index name followed by options: unique, sparse, desc, text,
+// 2dsphere, hashed, ttl=<seconds> and collation=<locale>. A text field may
+// also have weight=<n> and language=<name>, the default language of its
+// index. Fields tagged with the same index name form one compound index, in
+// field order. A collection has one text index, so all text fields are put in
+// it and at most one name may be given to it.
+//
+//	Email string `index:",unique"`
+//	City  string `index:"city_age"`
+//	Age   int    `index:"city_age,desc"`
+//	Title string `index:"search,text,weight=10"`
+//	Body  string `index:"search,text"`
+func ModelIndexes(obj interface{}) ([]IndexSpec, error) {
+	t := reflect.TypeOf(obj)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, toolkit.Errorf("unable to read indexes of %T, it should be a struct", obj)
+	}
+
+	specs := []IndexSpec{}
+	if err := tagIndexes(t, &specs); err != nil {
+		return nil, err
+	}
+	if indexer, ok := obj.(Indexer); ok {
+		specs = append(specs, indexer.Indexes()...)
+	}
+
+	names, texts := map[string]bool{}, 0
+	for i := range specs {
+		if len(specs[i].Keys) == 0 {
+			return nil, toolkit.Errorf("index %s of %T has no keys", specs[i].Name, obj)
+		}
+		if specs[i].hasText() {
+			if texts++; texts > 1 {
+				return nil, toolkit.Errorf("%T has more than one text index, a collection can only have one", obj)
+			}
+		}
+		name := specs[i].indexName()
+		if names[name] {
+			return nil, toolkit.Errorf("index %s of %T is declared twice", name, obj)
+		}
+		names[name] = true
+	}
+	return specs, nil
+}
+
+func tagIndexes(t reflect.Type, specs *[]IndexSpec) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+
+		field, inline, skip := bsonFieldName(f)
+		if skip {
+			continue
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if inline && ft.Kind() == reflect.Struct {
+			if err := tagIndexes(ft, specs); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tag, ok := f.Tag.Lookup("index")
+		if !ok {
+			continue
+		}
+		for _, entry := range strings.Split(tag, ";") {
+			if err := addTagIndex(specs, field, entry); err != nil {
+				return toolkit.Errorf("invalid index tag of %s. %s", f.Name, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// merge adds the key of field and the options of spec to s
+func (s *IndexSpec) merge(field string, key interface{}, spec IndexSpec) {
+	s.Keys = append(s.Keys, bson.E{Key: field, Value: key})
+	s.Unique = s.Unique || spec.Unique
+	s.Sparse = s.Sparse || spec.Sparse
+	if spec.ExpireAfterSeconds != nil {
+		s.ExpireAfterSeconds = spec.ExpireAfterSeconds
+	}
+	if spec.Collation != nil {
+		s.Collation = spec.Collation
+	}
+	for k, v := range spec.Weights {
+		if s.Weights == nil {
+			s.Weights = toolkit.M{}
+		}
+		s.Weights.Set(k, v)
+	}
+	if spec.DefaultLanguage != "" {
+		s.DefaultLanguage = spec.DefaultLanguage
+	}
+}
+
+// hasText tells whether s is a text index
+func (s *IndexSpec) hasText() bool {
+	for _, k := range s.Keys {
+		if k.Value == "text" {
+			return true
+		}
+	}
+	return false
+}
+
+func addTagIndex(specs *[]IndexSpec, field, entry string) error {
+	parts := strings.Split(entry, ",")
+	name := strings.TrimSpace(parts[0])
+
+	var key interface{} = 1
+	spec := IndexSpec{Name: name}
+	for _, p := range parts[1:] {
+		p = strings.TrimSpace(p)
+		opt, value := p, ""
+		if eq := strings.Index(p, "="); eq >= 0 {
+			opt, value = p[:eq], p[eq+1:]
+		}
+
+		switch strings.ToLower(opt) {
+		case "":
+		case "unique":
+			spec.Unique = true
+		case "sparse":
+			spec.Sparse = true
+		case "desc":
+			key = -1
+		case "text", "2dsphere", "hashed":
+			key = strings.ToLower(opt)
+		case "ttl":
+			seconds, err := strconv.ParseInt(value, 10, 32)
+			if err != nil || seconds < 0 {
+				return toolkit.Errorf("invalid ttl %s", value)
+			}
+			ttl := int32(seconds)
+			spec.ExpireAfterSeconds = &ttl
+		case "collation":
+			if value == "" {
+				return toolkit.Errorf("collation needs a locale")
+			}
+			spec.Collation = &options.Collation{Locale: value}
+		case "weight":
+			weight, err := strconv.ParseInt(value, 10, 32)
+			if err != nil || weight < 1 {
+				return toolkit.Errorf("invalid weight %s", value)
+			}
+			spec.Weights = toolkit.M{}.Set(field, int32(weight))
+		case "language":
+			if value == "" {
+				return toolkit.Errorf("language needs a name")
+			}
+			spec.DefaultLanguage = value
+		default:
+			return toolkit.Errorf("unknown option %s", opt)
+		}
+	}
+
+	if (spec.Weights != nil || spec.DefaultLanguage != "") && key != "text" {
+		return toolkit.Errorf("weight and language are options of a text index")
+	}
+
+	//-- fields sharing an index name are merged into one compound index, and
+	//-- the text fields into the one text index a collection can have
+	for i := range *specs {
+		s := &(*specs)[i]
+		sameName := name != "" && s.Name == name
+		if key == "text" && s.hasText() && !sameName {
+			if name != "" && s.Name != "" {
+				return toolkit.Errorf("text index %s can not be added, a collection has one text index and %s is another", name, s.Name)
+			}
+			if s.Name == "" {
+				s.Name = name
+			}
+		} else if !sameName {
+			continue
+		}
+		s.merge(field, key, spec)
+		return nil
+	}
+
+	spec.Keys = bson.D{{Key: field, Value: key}}
+	*specs = append(*specs, spec)
+	return nil
+}
+
+// EnsureIndexes creates the indexes of tablename that are not on the server
+// yet, so it can be called on every start. Indexes are matched by name, or
+// by keys when the server one has another name. The returned report lists
+// the created indexes as Missing. Conflicts are not changed and returned as
+// an error with the report.
+func (c *Connection) EnsureIndexes(tablename string, indexes ...IndexSpec) (*IndexReport, error) {
+	report, err := c.IndexDiff(tablename, indexes...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(report.Missing) > 0 {
+		models := make([]mongo.IndexModel, len(report.Missing))
+		for i, spec := range report.Missing {
+			models[i] = spec.model()
+		}
+		db, name, err := c.Table(tablename, "")
+		if err != nil {
+			return report, err
+		}
+		if _, err = db.Collection(name).Indexes().CreateMany(c.Context(), models); err != nil {
+			return report, toolkit.Errorf("unable to create indexes of %s. %s", tablename, err.Error())
+		}
+	}
+
+	if len(report.Conflicts) > 0 {
+		return report, toolkit.Errorf("conflicting indexes on %s: %s", tablename, strings.Join(report.Conflicts, "; "))
+	}
+	return report, nil
+}
+
+// EnsureModelIndexes calls EnsureIndexes with the table name and the
+// indexes declared by obj
+func (c *Connection) EnsureModelIndexes(obj interface{}) (*IndexReport, error) {
+	tn, ok := obj.(tableNamer)
+	if !ok {
+		return nil, toolkit.Errorf("unable to get table name of %T, it should implement TableName()", obj)
+	}
+	indexes, err := ModelIndexes(obj)
+	if err != nil {
+		return nil, err
+	}
+	return c.EnsureIndexes(tn.TableName(), indexes...)
+}
+
+// IndexDiff compares indexes with the ones of tablename on the server
+// without changing anything
+func (c *Connection) IndexDiff(tablename string, indexes ...IndexSpec) (*IndexReport, error) {
+	live, err := c.ListIndexes(tablename)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &IndexReport{Table: tablename, Missing: []IndexSpec{}, Extra: []IndexSpec{}, Conflicts: []string{}}
+	matched := map[string]bool{}
+	for _, spec := range indexes {
+		name := spec.indexName()
+		found := false
+		for _, l := range live {
+			if l.Name == name {
+				found = true
+				matched[l.Name] = true
+				if diff := spec.differences(l); diff != "" {
+					report.Conflicts = append(report.Conflicts, fmt.Sprintf("index %s %s", name, diff))
+				}
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		for _, l := range live {
+			if !matched[l.Name] && spec.differences(l) == "" {
+				found = true
+				matched[l.Name] = true
+				break
+			}
+		}
+		if !found {
+			spec.Name = name
+			report.Missing = append(report.Missing, spec)
+		}
+	}
+
+	for _, l := range live {
+		if !matched[l.Name] {
+			report.Extra = append(report.Extra, l)
+		}
+	}
+	return report, nil
+}
+
+// ListIndexes returns the indexes of tablename except the _id one
+func (c *Connection) ListIndexes(tablename string) ([]IndexSpec, error) {
+	db, name, err := c.Table(tablename, "")
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := c.Context()
+	cur, err := db.Collection(name).Indexes().List(ctx)
+	if err != nil {
+		return nil, toolkit.Errorf("unable to list indexes of %s. %s", tablename, err.Error())
+	}
+	defer cur.Close(ctx)
+
+	specs := []IndexSpec{}
+	for cur.Next(ctx) {
+		info := struct {
+			Name               string  `bson:"name"`
+			Key                bson.D  `bson:"key"`
+			Unique             bool    `bson:"unique"`
+			Sparse             bool    `bson:"sparse"`
+			ExpireAfterSeconds *int32  `bson:"expireAfterSeconds"`
+			PartialFilter      bson.M  `bson:"partialFilterExpression"`
+			Weights            bson.M  `bson:"weights"`
+			DefaultLanguage    string  `bson:"default_language"`
+			Collation          *bson.M `bson:"collation"`
+		}{}
+		if err = cur.Decode(&info); err != nil {
+			return nil, toolkit.Errorf("unable to decode index of %s. %s", tablename, err.Error())
+		}
+		if info.Name == "_id_" {
+			continue
+		}
+
+		spec := IndexSpec{
+			Name:               info.Name,
+			Keys:               liveIndexKeys(info.Key, info.Weights),
+			Unique:             info.Unique,
+			Sparse:             info.Sparse,
+			ExpireAfterSeconds: info.ExpireAfterSeconds,
+			DefaultLanguage:    info.DefaultLanguage,
+		}
+		if info.PartialFilter != nil {
+			spec.PartialFilter = toolkit.M(info.PartialFilter)
+		}
+		if info.Weights != nil {
+			spec.Weights = toolkit.M(info.Weights)
+		}
+		if info.Collation != nil {
+			collation := toolkit.M(*info.Collation)
+			spec.Collation = &options.Collation{
+				Locale:   collation.GetString("locale"),
+				Strength: collation.GetInt("strength"),
+			}
+		}
+		specs = append(specs, spec)
+	}
+	if err = cur.Err(); err != nil {
+		return nil, toolkit.Errorf("unable to list indexes of %s. %s", tablename, err.Error())
+	}
+	return specs, nil
+}
+
+// DropIndex drops the index name of tablename
+func (c *Connection) DropIndex(tablename, name string) error {
+	db, collname, err := c.Table(tablename, "")
+	if err != nil {
+		return err
+	}
+	if _, err = db.Collection(collname).Indexes().DropOne(c.Context(), name); err != nil {
+		return toolkit.Errorf("unable to drop index %s of %s. %s", name, tablename, err.Error())
+	}
+	return nil
+}
+
+// liveIndexKeys turns the internal keys of a text index, _fts and _ftsx,
+// back into the text fields it was created with
+func liveIndexKeys(keys bson.D, weights bson.M) bson.D {
+	res := bson.D{}
+	for _, k := range keys {
+		switch k.Key {
+		case "_fts":
+			fields := []string{}
+			for field := range weights {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			for _, field := range fields {
+				res = append(res, bson.E{Key: field, Value: "text"})
+			}
+		case "_ftsx":
+		default:
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+func (s IndexSpec) indexName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	parts := make([]string, len(s.Keys))
+	for i, k := range s.Keys {
+		parts[i] = k.Key + "_" + indexKeyValue(k.Value)
+	}
+	return strings.Join(parts, "_")
+}
+
+func (s IndexSpec) model() mongo.IndexModel {
+	opts := options.Index().SetName(s.indexName())
+	if s.Unique {
+		opts.SetUnique(true)
+	}
+	if s.Sparse {
+		opts.SetSparse(true)
+	}
+	if s.ExpireAfterSeconds != nil {
+		opts.SetExpireAfterSeconds(*s.ExpireAfterSeconds)
+	}
+	if s.PartialFilter != nil {
+		opts.SetPartialFilterExpression(s.PartialFilter)
+	}
+	if s.Collation != nil {
+		opts.SetCollation(s.Collation)
+	}
+	if s.Weights != nil {
+		opts.SetWeights(s.Weights)
+	}
+	if s.DefaultLanguage != "" {
+		opts.SetDefaultLanguage(s.DefaultLanguage)
+	}
+	return mongo.IndexModel{Keys: s.Keys, Options: opts}
+}
+
+// differences describes how live differs from s, it is empty when live
+// satisfies s. Options the server fills with defaults, like the language of
+// a text index, are only compared when s sets them.
+func (s IndexSpec) differences(live IndexSpec) string {
+	diffs := []string{}
+	if a, b := indexKeysText(s.Keys), indexKeysText(live.Keys); a != b {
+		diffs = append(diffs, fmt.Sprintf("keys are %s, expected %s", b, a))
+	}
+	if s.Unique != live.Unique {
+		diffs = append(diffs, fmt.Sprintf("unique is %v, expected %v", live.Unique, s.Unique))
+	}
+	if s.Sparse != live.Sparse {
+		diffs = append(diffs, fmt.Sprintf("sparse is %v, expected %v", live.Sparse, s.Sparse))
+	}
+	if a, b := ttlText(s.ExpireAfterSeconds), ttlText(live.ExpireAfterSeconds); a != b {
+		diffs = append(diffs, fmt.Sprintf("ttl is %s, expected %s", b, a))
+	}
+	if !sameValue(s.PartialFilter, live.PartialFilter) {
+		diffs = append(diffs, fmt.Sprintf("partial filter is %s, expected %s", jsonText(live.PartialFilter), jsonText(s.PartialFilter)))
+	}
+	if a, b := collationText(s.Collation, s.Collation), collationText(live.Collation, s.Collation); a != b {
+		diffs = append(diffs, fmt.Sprintf("collation is %s, expected %s", b, a))
+	}
+	for field, weight := range s.Weights {
+		//-- the server gives a weight of 1 to the text fields without one
+		if !sameValue(weight, live.Weights[field]) {
+			diffs = append(diffs, fmt.Sprintf("weights are %s, expected %s", jsonText(live.Weights), jsonText(s.Weights)))
+			break
+		}
+	}
+	if s.DefaultLanguage != "" && s.DefaultLanguage != live.DefaultLanguage {
+		diffs = append(diffs, fmt.Sprintf("default language is %s, expected %s", live.DefaultLanguage, s.DefaultLanguage))
+	}
+	return strings.Join(diffs, ", ")
+}
+
+// indexKeysText writes keys as field:value, consecutive text keys are sorted
+// as their order is not kept by the server
+func indexKeysText(keys bson.D) string {
+	parts := []string{}
+	texts := []string{}
+	flush := func() {
+		sort.Strings(texts)
+		parts = append(parts, texts...)
+		texts = texts[:0]
+	}
+	for _, k := range keys {
+		v := indexKeyValue(k.Value)
+		if v == "text" {
+			texts = append(texts, k.Key+":text")
+			continue
+		}
+		flush()
+		parts = append(parts, k.Key+":"+v)
+	}
+	flush()
+	return strings.Join(parts, ",")
+}
+
+func indexKeyValue(v interface{}) string {
+	switch n := v.(type) {
+	case int, int8, int16, int32, int64:
+		return fmt.Sprintf("%d", n)
+	case float32:
+		return strconv.FormatFloat(float64(n), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func ttlText(ttl *int32) string {
+	if ttl == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%ds", *ttl)
+}
+
+// collationText writes the locale of c and its strength when ref sets one
+func collationText(c, ref *options.Collation) string {
+	if c == nil {
+		return "none"
+	}
+	if ref != nil && ref.Strength != 0 {
+		return fmt.Sprintf("%s/%d", c.Locale, c.Strength)
+	}
+	return c.Locale
+}
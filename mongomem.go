@@ -0,0 +1,551 @@
+package flexmgo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eaciit/toolkit"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	memServersMtx sync.Mutex
+	memServers    = map[string]*memServer{}
+)
+
+// memServer keeps the databases of mongomem connections in memory, it is
+// shared by the connections having the same host. Documents are stored the
+// way the driver would send them, so they decode like documents read from a
+// server. The data lives as long as the process, ResetMemServer empties it.
+type memServer struct {
+	mtx sync.RWMutex
+	dbs map[string]map[string][]bson.D
+}
+
+// memServerOf returns the mongomem server name, creating it if needed
+func memServerOf(name string) *memServer {
+	memServersMtx.Lock()
+	defer memServersMtx.Unlock()
+
+	s, ok := memServers[name]
+	if !ok {
+		s = &memServer{dbs: map[string]map[string][]bson.D{}}
+		memServers[name] = s
+	}
+	return s
+}
+
+// ResetMemServer drops every database of the mongomem server name, the host
+// of its connection string. It is meant to isolate tests.
+func ResetMemServer(name string) {
+	s := memServerOf(name)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.dbs = map[string]map[string][]bson.D{}
+}
+
+func (s *memServer) collection(database, name string) *memCollection {
+	return &memCollection{server: s, db: database, name: name}
+}
+
+func (s *memServer) drop(database, name string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.dbs[database], name)
+	return nil
+}
+
+func (s *memServer) collectionNames(database string) []string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	names := []string{}
+	for name := range s.dbs[database] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// memCollection is a collection of a memServer
+type memCollection struct {
+	server *memServer
+	db     string
+	name   string
+}
+
+func (c *memCollection) Name() string {
+	return c.name
+}
+
+func (c *memCollection) Database() string {
+	return c.db
+}
+
+// docs returns the documents of the collection, the caller holds the lock
+func (c *memCollection) docs() []bson.D {
+	return c.server.dbs[c.db][c.name]
+}
+
+// setDocs replaces the documents of the collection, the caller holds the
+// write lock
+func (c *memCollection) setDocs(docs []bson.D) {
+	colls, ok := c.server.dbs[c.db]
+	if !ok {
+		colls = map[string][]bson.D{}
+		c.server.dbs[c.db] = colls
+	}
+	colls[c.name] = docs
+}
+
+// matching returns the documents matching filter
+func (c *memCollection) matching(filter interface{}) ([]bson.D, error) {
+	f, err := memDoc(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	c.server.mtx.RLock()
+	defer c.server.mtx.RUnlock()
+	res := []bson.D{}
+	for _, doc := range c.docs() {
+		ok, err := matchDoc(doc, f)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			res = append(res, doc)
+		}
+	}
+	return res, nil
+}
+
+func (c *memCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	opt := options.MergeFindOptions(opts...)
+	//-- hints, time limits and batches do not change what is found
+	if opt.Collation != nil {
+		return nil, memUnsupported("collations")
+	}
+	if opt.Min != nil || opt.Max != nil || (opt.ReturnKey != nil && *opt.ReturnKey) {
+		return nil, memUnsupported("index bounds and keys")
+	}
+
+	docs, err := c.matching(filter)
+	if err != nil {
+		return nil, err
+	}
+	if opt.Sort != nil {
+		spec, err := memDoc(opt.Sort)
+		if err != nil {
+			return nil, toolkit.Errorf("invalid sort. %s", err.Error())
+		}
+		if docs, err = sortDocs(docs, spec); err != nil {
+			return nil, err
+		}
+	}
+	var skip, limit int64
+	if opt.Skip != nil {
+		skip = *opt.Skip
+	}
+	if opt.Limit != nil {
+		limit = *opt.Limit
+	}
+	docs = skipLimit(docs, skip, limit)
+	if opt.Projection != nil {
+		spec, err := memDoc(opt.Projection)
+		if err != nil {
+			return nil, toolkit.Errorf("invalid projection. %s", err.Error())
+		}
+		if docs, err = projectDocs(docs, spec); err != nil {
+			return nil, err
+		}
+	}
+	return memCursor(docs)
+}
+
+func (c *memCollection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if options.MergeAggregateOptions(opts...).Collation != nil {
+		return nil, memUnsupported("collations")
+	}
+	stages, err := memDocs(pipeline)
+	if err != nil {
+		return nil, toolkit.Errorf("invalid pipeline. %s", err.Error())
+	}
+
+	docs, err := c.matching(bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	if docs, err = aggregateDocs(docs, stages); err != nil {
+		return nil, err
+	}
+	return memCursor(docs)
+}
+
+func (c *memCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	doc, err := memDoc(document)
+	if err != nil {
+		return nil, err
+	}
+
+	id, ok := lookupKey(doc, "_id")
+	if !ok {
+		id = primitive.NewObjectID()
+		doc = append(bson.D{{Key: "_id", Value: id}}, doc...)
+	}
+
+	c.server.mtx.Lock()
+	defer c.server.mtx.Unlock()
+	if err = c.checkDuplicate(id); err != nil {
+		return nil, err
+	}
+	c.setDocs(append(c.docs(), doc))
+	return &mongo.InsertOneResult{InsertedID: id}, nil
+}
+
+// checkDuplicate returns the error of the server for a duplicate _id, the
+// caller holds the lock
+func (c *memCollection) checkDuplicate(id interface{}) error {
+	for _, doc := range c.docs() {
+		if other, _ := lookupKey(doc, "_id"); compareValues(other, id) == 0 {
+			return mongo.WriteException{WriteErrors: mongo.WriteErrors{{
+				Code:    11000,
+				Message: fmt.Sprintf("E11000 duplicate key error collection: %s.%s index: _id_ dup key: { _id: %v }", c.db, c.name, id),
+			}}}
+		}
+	}
+	return nil
+}
+
+func (c *memCollection) UpdateOne(ctx context.Context, filter, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return c.update(ctx, filter, update, false, opts)
+}
+
+func (c *memCollection) UpdateMany(ctx context.Context, filter, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return c.update(ctx, filter, update, true, opts)
+}
+
+func (c *memCollection) update(ctx context.Context, filter, update interface{}, multi bool, opts []*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	opt := options.MergeUpdateOptions(opts...)
+
+	f, err := memDoc(filter)
+	if err != nil {
+		return nil, err
+	}
+	u, err := memDoc(update)
+	if err != nil {
+		return nil, err
+	}
+	if len(u) == 0 || len(u[0].Key) == 0 || u[0].Key[0] != '$' {
+		return nil, toolkit.Errorf("update document must contain key beginning with '$'")
+	}
+
+	c.server.mtx.Lock()
+	defer c.server.mtx.Unlock()
+
+	res := &mongo.UpdateResult{}
+	docs := append([]bson.D{}, c.docs()...)
+	for i, doc := range docs {
+		ok, err := matchDoc(doc, f)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		res.MatchedCount++
+		updated, err := applyUpdate(doc, u, false)
+		if err != nil {
+			return nil, err
+		}
+		if compareValues(doc, updated) != 0 {
+			docs[i] = updated
+			res.ModifiedCount++
+		}
+		if !multi {
+			break
+		}
+	}
+
+	if res.MatchedCount == 0 && opt.Upsert != nil && *opt.Upsert {
+		doc, err := applyUpdate(upsertDoc(f), u, true)
+		if err != nil {
+			return nil, err
+		}
+		id, ok := lookupKey(doc, "_id")
+		if !ok {
+			id = primitive.NewObjectID()
+			doc = append(bson.D{{Key: "_id", Value: id}}, doc...)
+		}
+		if err = c.checkDuplicate(id); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+		res.UpsertedCount = 1
+		res.UpsertedID = id
+	}
+
+	c.setDocs(docs)
+	return res, nil
+}
+
+func (c *memCollection) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f, err := memDoc(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	c.server.mtx.Lock()
+	defer c.server.mtx.Unlock()
+
+	res := &mongo.DeleteResult{}
+	kept := []bson.D{}
+	for _, doc := range c.docs() {
+		ok, err := matchDoc(doc, f)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			res.DeletedCount++
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	if _, exists := c.server.dbs[c.db][c.name]; exists {
+		c.setDocs(kept)
+	}
+	return res, nil
+}
+
+func (c *memCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	opt := options.MergeCountOptions(opts...)
+
+	docs, err := c.matching(filter)
+	if err != nil {
+		return 0, err
+	}
+	var skip, limit int64
+	if opt.Skip != nil {
+		skip = *opt.Skip
+	}
+	if opt.Limit != nil {
+		limit = *opt.Limit
+	}
+	return int64(len(skipLimit(docs, skip, limit))), nil
+}
+
+func (c *memCollection) Count(ctx context.Context, filter interface{}) (int64, error) {
+	return c.CountDocuments(ctx, filter)
+}
+
+func (c *memCollection) Watch(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (*mongo.ChangeStream, error) {
+	return nil, memUnsupported("change streams")
+}
+
+func (c *memCollection) RunCommand(ctx context.Context, cmd interface{}) *mongo.SingleResult {
+	return mongo.NewSingleResultFromDocument(bson.D{}, memUnsupported("database commands"), nil)
+}
+
+func (c *memCollection) RunCommandCursor(ctx context.Context, cmd interface{}) (*mongo.Cursor, error) {
+	return nil, memUnsupported("database commands")
+}
+
+func (c *memCollection) Bucket(chunkSize int32) (fileBucket, error) {
+	if chunkSize <= 0 {
+		return nil, toolkit.Errorf("chunk size should be positive")
+	}
+	return &memBucket{
+		files:     c.server.collection(c.db, c.name+".files"),
+		chunks:    c.server.collection(c.db, c.name+".chunks"),
+		chunkSize: chunkSize,
+	}, nil
+}
+
+// memBucket is a GridFS bucket of a memServer. Files and chunks are kept in
+// the same collections and shape as GridFS does.
+type memBucket struct {
+	files     *memCollection
+	chunks    *memCollection
+	chunkSize int32
+}
+
+func (b *memBucket) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (b *memBucket) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (b *memBucket) UploadFromStream(filename string, source io.Reader, opts ...*options.UploadOptions) (primitive.ObjectID, error) {
+	id := primitive.NewObjectID()
+	return id, b.UploadFromStreamWithID(id, filename, source, opts...)
+}
+
+func (b *memBucket) UploadFromStreamWithID(id interface{}, filename string, source io.Reader, opts ...*options.UploadOptions) error {
+	data, err := ioutil.ReadAll(source)
+	if err != nil {
+		return err
+	}
+
+	file := bson.D{
+		{Key: "_id", Value: id},
+		{Key: "length", Value: int64(len(data))},
+		{Key: "chunkSize", Value: b.chunkSize},
+		{Key: "uploadDate", Value: primitive.NewDateTimeFromTime(time.Now())},
+		{Key: "filename", Value: filename},
+	}
+	for _, opt := range opts {
+		if opt != nil && opt.Metadata != nil {
+			file = append(file, bson.E{Key: "metadata", Value: opt.Metadata})
+		}
+	}
+
+	ctx := context.Background()
+	if _, err = b.files.InsertOne(ctx, file); err != nil {
+		return err
+	}
+	for n := 0; n*int(b.chunkSize) < len(data); n++ {
+		end := (n + 1) * int(b.chunkSize)
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := bson.D{
+			{Key: "files_id", Value: id},
+			{Key: "n", Value: int32(n)},
+			{Key: "data", Value: primitive.Binary{Data: data[n*int(b.chunkSize) : end]}},
+		}
+		if _, err = b.chunks.InsertOne(ctx, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memBucket) OpenDownloadStream(id interface{}) (io.ReadCloser, error) {
+	return b.download(bson.D{{Key: "_id", Value: id}})
+}
+
+func (b *memBucket) OpenDownloadStreamByName(filename string) (io.ReadCloser, error) {
+	return b.download(bson.D{{Key: "filename", Value: filename}})
+}
+
+// download reads the most recent file matching filter
+func (b *memBucket) download(filter bson.D) (io.ReadCloser, error) {
+	files, err := b.files.matching(filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, gridfs.ErrFileNotFound
+	}
+	files, _ = sortDocs(files, bson.D{{Key: "uploadDate", Value: int32(-1)}})
+	id, _ := lookupKey(files[0], "_id")
+
+	chunks, err := b.chunks.matching(bson.D{{Key: "files_id", Value: id}})
+	if err != nil {
+		return nil, err
+	}
+	chunks, _ = sortDocs(chunks, bson.D{{Key: "n", Value: int32(1)}})
+
+	var buff bytes.Buffer
+	for _, chunk := range chunks {
+		if data, ok := lookupKey(chunk, "data"); ok {
+			buff.Write(data.(primitive.Binary).Data)
+		}
+	}
+	return ioutil.NopCloser(&buff), nil
+}
+
+func (b *memBucket) DeleteContext(ctx context.Context, id interface{}) error {
+	res, err := b.files.DeleteMany(ctx, bson.D{{Key: "_id", Value: id}})
+	if err != nil {
+		return err
+	}
+	if _, err = b.chunks.DeleteMany(ctx, bson.D{{Key: "files_id", Value: id}}); err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return gridfs.ErrFileNotFound
+	}
+	return nil
+}
+
+func (b *memBucket) DropContext(ctx context.Context) error {
+	b.files.server.drop(b.files.db, b.files.name)
+	return b.chunks.server.drop(b.chunks.db, b.chunks.name)
+}
+
+// memCursor returns a driver cursor over docs
+func memCursor(docs []bson.D) (*mongo.Cursor, error) {
+	items := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		items[i] = doc
+	}
+	return mongo.NewCursorFromDocuments(items, nil, nil)
+}
+
+// memDoc returns v as the document the driver would send to the server
+func memDoc(v interface{}) (bson.D, error) {
+	if v == nil {
+		return bson.D{}, nil
+	}
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.D{}
+	if err = bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// memDocs returns a list of documents, like a pipeline, as the driver would
+// send them
+func memDocs(v interface{}) ([]bson.D, error) {
+	raw, err := bson.Marshal(bson.D{{Key: "v", Value: v}})
+	if err != nil {
+		return nil, err
+	}
+	res := struct {
+		V []bson.D `bson:"v"`
+	}{}
+	if err = bson.Unmarshal(raw, &res); err != nil {
+		return nil, err
+	}
+	return res.V, nil
+}
+
+func memUnsupported(what string) error {
+	return toolkit.Errorf("%s are not supported by mongomem", what)
+}
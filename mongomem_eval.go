@@ -0,0 +1,1550 @@
+package flexmgo
+
+import (
+	"bytes"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eaciit/toolkit"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// typeOrder is the rank of a value in the BSON comparison order, numbers of
+// every type share the same rank
+func typeOrder(v interface{}) int {
+	switch v.(type) {
+	case primitive.MinKey:
+		return 1
+	case nil, primitive.Null, primitive.Undefined:
+		return 2
+	case int32, int64, float64, primitive.Decimal128:
+		return 3
+	case string, primitive.Symbol:
+		return 4
+	case bson.D:
+		return 5
+	case bson.A:
+		return 6
+	case primitive.Binary:
+		return 7
+	case primitive.ObjectID:
+		return 8
+	case bool:
+		return 9
+	case primitive.DateTime:
+		return 10
+	case primitive.Timestamp:
+		return 11
+	case primitive.Regex:
+		return 12
+	case primitive.MaxKey:
+		return 14
+	}
+	return 13
+}
+
+// number returns v as a float64 when it is a number
+func number(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case int32:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case float64:
+		return x, true
+	case primitive.Decimal128:
+		f, err := strconv.ParseFloat(x.String(), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func sign(b bool, lt bool) int {
+	if b {
+		return 0
+	}
+	if lt {
+		return -1
+	}
+	return 1
+}
+
+// compareValues compares a and b the way the server sorts them
+func compareValues(a, b interface{}) int {
+	ta, tb := typeOrder(a), typeOrder(b)
+	if ta != tb {
+		return sign(false, ta < tb)
+	}
+
+	switch x := a.(type) {
+	case int32, int64, float64, primitive.Decimal128:
+		ia, aInt := toInt64(a)
+		ib, bInt := toInt64(b)
+		if aInt && bInt {
+			return sign(ia == ib, ia < ib)
+		}
+		fa, _ := number(a)
+		fb, _ := number(b)
+		return sign(fa == fb, fa < fb)
+	case string:
+		return strings.Compare(x, stringOf(b))
+	case primitive.Symbol:
+		return strings.Compare(string(x), stringOf(b))
+	case bson.D:
+		y := b.(bson.D)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := strings.Compare(x[i].Key, y[i].Key); c != 0 {
+				return c
+			}
+			if c := compareValues(x[i].Value, y[i].Value); c != 0 {
+				return c
+			}
+		}
+		return sign(len(x) == len(y), len(x) < len(y))
+	case bson.A:
+		y := b.(bson.A)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := compareValues(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return sign(len(x) == len(y), len(x) < len(y))
+	case primitive.Binary:
+		y := b.(primitive.Binary)
+		if len(x.Data) != len(y.Data) {
+			return sign(false, len(x.Data) < len(y.Data))
+		}
+		if x.Subtype != y.Subtype {
+			return sign(false, x.Subtype < y.Subtype)
+		}
+		return bytes.Compare(x.Data, y.Data)
+	case primitive.ObjectID:
+		y := b.(primitive.ObjectID)
+		return bytes.Compare(x[:], y[:])
+	case bool:
+		y := b.(bool)
+		return sign(x == y, !x)
+	case primitive.DateTime:
+		y := b.(primitive.DateTime)
+		return sign(x == y, x < y)
+	case primitive.Timestamp:
+		y := b.(primitive.Timestamp)
+		if x.T != y.T {
+			return sign(false, x.T < y.T)
+		}
+		return sign(x.I == y.I, x.I < y.I)
+	case primitive.Regex:
+		y := b.(primitive.Regex)
+		if c := strings.Compare(x.Pattern, y.Pattern); c != 0 {
+			return c
+		}
+		return strings.Compare(x.Options, y.Options)
+	}
+	return 0
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch x := v.(type) {
+	case int32:
+		return int64(x), true
+	case int64:
+		return x, true
+	}
+	return 0, false
+}
+
+func stringOf(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case primitive.Symbol:
+		return string(x)
+	}
+	return ""
+}
+
+// lookupKey returns the value of key in doc
+func lookupKey(doc bson.D, key string) (interface{}, bool) {
+	for _, e := range doc {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// resolvePath returns the values reached by the dotted path parts from v.
+// Arrays of documents are traversed like the server does, so a.b reaches the
+// b of every document of the array a.
+func resolvePath(v interface{}, parts []string) []interface{} {
+	if len(parts) == 0 {
+		return []interface{}{v}
+	}
+
+	switch x := v.(type) {
+	case bson.D:
+		if value, ok := lookupKey(x, parts[0]); ok {
+			return resolvePath(value, parts[1:])
+		}
+	case bson.A:
+		res := []interface{}{}
+		if i, err := strconv.Atoi(parts[0]); err == nil && i >= 0 && i < len(x) {
+			res = append(res, resolvePath(x[i], parts[1:])...)
+		}
+		for _, item := range x {
+			if _, ok := item.(bson.D); ok {
+				res = append(res, resolvePath(item, parts)...)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+// pathValue returns the value at path without traversing arrays, the way
+// aggregation field references and sort keys read a document
+func pathValue(doc bson.D, path string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		switch x := v.(type) {
+		case bson.D:
+			value, ok := lookupKey(x, part)
+			if !ok {
+				return nil, false
+			}
+			v = value
+		case bson.A:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(x) {
+				return nil, false
+			}
+			v = x[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// matchDoc tells if doc matches the query filter
+func matchDoc(doc bson.D, filter bson.D) (bool, error) {
+	for _, e := range filter {
+		var (
+			ok  bool
+			err error
+		)
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			ok, err = matchLogical(doc, e.Key, e.Value)
+		case "$comment":
+			ok = true
+		default:
+			if strings.HasPrefix(e.Key, "$") {
+				return false, toolkit.Errorf("operator %s is not supported by mongomem", e.Key)
+			}
+			ok, err = matchField(resolvePath(doc, strings.Split(e.Key, ".")), e.Value)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchLogical(doc bson.D, op string, v interface{}) (bool, error) {
+	items, ok := v.(bson.A)
+	if !ok || len(items) == 0 {
+		return false, toolkit.Errorf("%s must be a nonempty array", op)
+	}
+	for _, item := range items {
+		sub, ok := item.(bson.D)
+		if !ok {
+			return false, toolkit.Errorf("%s argument's entries must be objects", op)
+		}
+		matched, err := matchDoc(doc, sub)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case op == "$and" && !matched:
+			return false, nil
+		case op == "$or" && matched:
+			return true, nil
+		case op == "$nor" && matched:
+			return false, nil
+		}
+	}
+	return op != "$or", nil
+}
+
+// isOperatorDoc tells if v is a document of query operators like {$gt: 1}
+func isOperatorDoc(v interface{}) bool {
+	d, ok := v.(bson.D)
+	return ok && len(d) > 0 && strings.HasPrefix(d[0].Key, "$")
+}
+
+// matchField tells if the values a path reached match the condition cond
+func matchField(values []interface{}, cond interface{}) (bool, error) {
+	if isOperatorDoc(cond) {
+		return matchOperators(values, cond.(bson.D))
+	}
+	if re, ok := cond.(primitive.Regex); ok {
+		return matchRegex(values, re.Pattern, re.Options)
+	}
+	return matchEqual(values, cond), nil
+}
+
+// expand adds the items of the array values to values
+func expand(values []interface{}) []interface{} {
+	res := []interface{}{}
+	for _, v := range values {
+		res = append(res, v)
+		if a, ok := v.(bson.A); ok {
+			res = append(res, a...)
+		}
+	}
+	return res
+}
+
+func matchEqual(values []interface{}, v interface{}) bool {
+	if v == nil && len(values) == 0 {
+		//-- a missing field equals null
+		return true
+	}
+	for _, item := range expand(values) {
+		if compareValues(item, v) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOperators(values []interface{}, ops bson.D) (bool, error) {
+	for _, op := range ops {
+		var (
+			ok  bool
+			err error
+		)
+		switch op.Key {
+		case "$eq":
+			ok = matchEqual(values, op.Value)
+		case "$ne":
+			ok = !matchEqual(values, op.Value)
+		case "$gt", "$gte", "$lt", "$lte":
+			ok = matchCompare(values, op.Key, op.Value)
+		case "$in", "$nin":
+			items, isArray := op.Value.(bson.A)
+			if !isArray {
+				return false, toolkit.Errorf("%s needs an array", op.Key)
+			}
+			if ok, err = matchIn(values, items); op.Key == "$nin" {
+				ok = !ok
+			}
+		case "$exists":
+			ok = truthy(op.Value) == (len(values) > 0)
+		case "$regex":
+			pattern, options := "", ""
+			switch re := op.Value.(type) {
+			case string:
+				pattern = re
+			case primitive.Regex:
+				pattern, options = re.Pattern, re.Options
+			default:
+				return false, toolkit.Errorf("$regex has to be a string")
+			}
+			if o, has := lookupKey(ops, "$options"); has {
+				options = stringOf(o)
+			}
+			ok, err = matchRegex(values, pattern, options)
+		case "$options":
+			if _, has := lookupKey(ops, "$regex"); !has {
+				return false, toolkit.Errorf("$options needs a $regex")
+			}
+			ok = true
+		case "$not":
+			switch op.Value.(type) {
+			case bson.D, primitive.Regex:
+			default:
+				return false, toolkit.Errorf("$not needs a regex or a document")
+			}
+			ok, err = matchField(values, op.Value)
+			ok = !ok
+		case "$size":
+			n, isNumber := toInt64(op.Value)
+			if f, isFloat := op.Value.(float64); isFloat && f == math.Trunc(f) {
+				n, isNumber = int64(f), true
+			}
+			if !isNumber {
+				return false, toolkit.Errorf("$size needs a number")
+			}
+			for _, v := range values {
+				if a, isArray := v.(bson.A); isArray && int64(len(a)) == n {
+					ok = true
+				}
+			}
+		case "$all":
+			items, isArray := op.Value.(bson.A)
+			if !isArray {
+				return false, toolkit.Errorf("$all needs an array")
+			}
+			ok, err = matchAll(values, items)
+		case "$elemMatch":
+			cond, isDoc := op.Value.(bson.D)
+			if !isDoc {
+				return false, toolkit.Errorf("$elemMatch needs an Object")
+			}
+			ok, err = matchElem(values, cond)
+		case "$mod":
+			ok, err = matchMod(values, op.Value)
+		case "$type":
+			ok, err = matchType(values, op.Value)
+		default:
+			return false, toolkit.Errorf("operator %s is not supported by mongomem", op.Key)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	}
+	if f, ok := number(v); ok {
+		return f != 0
+	}
+	return true
+}
+
+func matchCompare(values []interface{}, op string, v interface{}) bool {
+	for _, item := range expand(values) {
+		if typeOrder(item) != typeOrder(v) {
+			continue
+		}
+		c := compareValues(item, v)
+		switch {
+		case op == "$gt" && c > 0, op == "$gte" && c >= 0, op == "$lt" && c < 0, op == "$lte" && c <= 0:
+			return true
+		}
+	}
+	return false
+}
+
+func matchIn(values []interface{}, items bson.A) (bool, error) {
+	for _, item := range items {
+		if re, ok := item.(primitive.Regex); ok {
+			matched, err := matchRegex(values, re.Pattern, re.Options)
+			if err != nil || matched {
+				return matched, err
+			}
+			continue
+		}
+		if isOperatorDoc(item) {
+			return false, toolkit.Errorf("cannot nest $ under $in")
+		}
+		if matchEqual(values, item) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func matchRegex(values []interface{}, pattern, options string) (bool, error) {
+	flags := ""
+	for _, o := range options {
+		switch o {
+		case 'i', 'm', 's':
+			flags += string(o)
+		case 'x':
+			//-- extended mode is not supported by go regexp
+		default:
+			return false, toolkit.Errorf("invalid flag in regex options: %c", o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, toolkit.Errorf("invalid regular expression. %s", err.Error())
+	}
+	for _, item := range expand(values) {
+		switch x := item.(type) {
+		case string:
+			if re.MatchString(x) {
+				return true, nil
+			}
+		case primitive.Symbol:
+			if re.MatchString(string(x)) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func matchAll(values []interface{}, items bson.A) (bool, error) {
+	if len(items) == 0 {
+		return false, nil
+	}
+	for _, v := range values {
+		all := true
+		for _, item := range items {
+			var (
+				ok  bool
+				err error
+			)
+			if d, isDoc := item.(bson.D); isDoc && len(d) == 1 && d[0].Key == "$elemMatch" {
+				ok, err = matchField([]interface{}{v}, d)
+			} else {
+				ok, err = matchField([]interface{}{v}, item)
+			}
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func matchElem(values []interface{}, cond bson.D) (bool, error) {
+	for _, v := range values {
+		a, ok := v.(bson.A)
+		if !ok {
+			continue
+		}
+		for _, item := range a {
+			var matched bool
+			var err error
+			if isOperatorDoc(cond) && cond[0].Key != "$and" && cond[0].Key != "$or" && cond[0].Key != "$nor" {
+				matched, err = matchOperators([]interface{}{item}, cond)
+			} else if doc, isDoc := item.(bson.D); isDoc {
+				matched, err = matchDoc(doc, cond)
+			}
+			if err != nil || matched {
+				return matched, err
+			}
+		}
+	}
+	return false, nil
+}
+
+func matchMod(values []interface{}, v interface{}) (bool, error) {
+	args, ok := v.(bson.A)
+	if !ok || len(args) != 2 {
+		return false, toolkit.Errorf("malformed mod, needs to be an array of divisor and remainder")
+	}
+	divisor, dok := number(args[0])
+	remainder, rok := number(args[1])
+	if !dok || !rok {
+		return false, toolkit.Errorf("malformed mod, divisor and remainder should be numbers")
+	}
+	if int64(divisor) == 0 {
+		return false, toolkit.Errorf("divisor cannot be 0")
+	}
+	for _, item := range expand(values) {
+		if f, ok := number(item); ok && int64(f)%int64(divisor) == int64(remainder) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func bsonTypeOf(v interface{}) int {
+	switch v.(type) {
+	case float64:
+		return 1
+	case string:
+		return 2
+	case bson.D:
+		return 3
+	case bson.A:
+		return 4
+	case primitive.Binary:
+		return 5
+	case primitive.Undefined:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime:
+		return 9
+	case nil, primitive.Null:
+		return 10
+	case primitive.Regex:
+		return 11
+	case primitive.JavaScript:
+		return 13
+	case primitive.Symbol:
+		return 14
+	case int32:
+		return 16
+	case primitive.Timestamp:
+		return 17
+	case int64:
+		return 18
+	case primitive.Decimal128:
+		return 19
+	case primitive.MinKey:
+		return -1
+	case primitive.MaxKey:
+		return 127
+	}
+	return 0
+}
+
+func matchType(values []interface{}, v interface{}) (bool, error) {
+	types := bson.A{v}
+	if a, ok := v.(bson.A); ok {
+		types = a
+	}
+
+	for _, t := range types {
+		code := 0
+		switch x := t.(type) {
+		case string:
+			if x == "number" {
+				for _, item := range expand(values) {
+					if _, ok := number(item); ok {
+						return true, nil
+					}
+				}
+				continue
+			}
+			n, ok := bsonTypes[x]
+			if !ok {
+				return false, toolkit.Errorf("unknown type name alias: %s", x)
+			}
+			code = n
+		default:
+			f, ok := number(t)
+			if !ok {
+				return false, toolkit.Errorf("type must be represented as a number or a string")
+			}
+			code = int(f)
+		}
+
+		for _, item := range expand(values) {
+			if bsonTypeOf(item) == code {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// sortDocs sorts docs by spec, a document of field and direction
+func sortDocs(docs []bson.D, spec bson.D) ([]bson.D, error) {
+	for _, e := range spec {
+		if _, ok := number(e.Value); !ok {
+			return nil, toolkit.Errorf("invalid sort direction for %s, sort by $meta is not supported by mongomem", e.Key)
+		}
+	}
+
+	res := append([]bson.D{}, docs...)
+	sort.SliceStable(res, func(i, j int) bool {
+		for _, e := range spec {
+			dir, _ := number(e.Value)
+			a := sortKey(res[i], e.Key, dir < 0)
+			b := sortKey(res[j], e.Key, dir < 0)
+			if c := compareValues(a, b); c != 0 {
+				return (c < 0) == (dir > 0)
+			}
+		}
+		return false
+	})
+	return res, nil
+}
+
+// sortKey is the value docs are sorted on, the lowest item of an array when
+// sorting ascending and the highest when descending
+func sortKey(doc bson.D, path string, desc bool) interface{} {
+	var (
+		key   interface{}
+		found bool
+	)
+	for _, v := range expand(resolvePath(doc, strings.Split(path, "."))) {
+		if _, ok := v.(bson.A); ok {
+			continue
+		}
+		if c := compareValues(v, key); !found || (desc && c > 0) || (!desc && c < 0) {
+			key, found = v, true
+		}
+	}
+	return key
+}
+
+// skipLimit applies skip and limit to docs, a negative limit is taken like
+// the server does as a positive one
+func skipLimit(docs []bson.D, skip, limit int64) []bson.D {
+	if skip > 0 {
+		if skip >= int64(len(docs)) {
+			return []bson.D{}
+		}
+		docs = docs[skip:]
+	}
+	if limit < 0 {
+		limit = -limit
+	}
+	if limit > 0 && limit < int64(len(docs)) {
+		docs = docs[:limit]
+	}
+	return docs
+}
+
+// projectDocs applies a find projection to docs
+func projectDocs(docs []bson.D, spec bson.D) ([]bson.D, error) {
+	include, exclude := false, false
+	idIncluded := true
+	fields, ops := bson.D{}, bson.D{}
+	for _, e := range spec {
+		if op, ok := e.Value.(bson.D); ok {
+			if len(op) != 1 || (op[0].Key != "$slice" && op[0].Key != "$elemMatch") {
+				return nil, toolkit.Errorf("projection operators of %s are not supported by mongomem", e.Key)
+			}
+			//-- $elemMatch includes its field, $slice keeps the other fields
+			if op[0].Key == "$elemMatch" {
+				include = true
+			}
+			ops = append(ops, e)
+			continue
+		}
+		fields = append(fields, e)
+		if e.Key == "_id" {
+			idIncluded = truthy(e.Value)
+			continue
+		}
+		if truthy(e.Value) {
+			include = true
+		} else {
+			exclude = true
+		}
+	}
+	if include && exclude {
+		return nil, toolkit.Errorf("projection cannot have a mix of inclusion and exclusion")
+	}
+
+	res := make([]bson.D, len(docs))
+	for i, doc := range docs {
+		var out bson.D
+		if include {
+			out = bson.D{}
+			if id, ok := lookupKey(doc, "_id"); ok && idIncluded {
+				out = append(out, bson.E{Key: "_id", Value: id})
+			}
+			for _, e := range fields {
+				if e.Key != "_id" {
+					out = includePath(doc, out, strings.Split(e.Key, "."))
+				}
+			}
+		} else {
+			out = copyDoc(doc)
+			for _, e := range fields {
+				if e.Key != "_id" || !idIncluded {
+					out = unsetPath(out, strings.Split(e.Key, "."))
+				}
+			}
+		}
+
+		var err error
+		if out, err = projectOperators(doc, out, ops); err != nil {
+			return nil, err
+		}
+		res[i] = out
+	}
+	return res, nil
+}
+
+// projectOperators applies the $slice and $elemMatch projections ops of doc
+// to out
+func projectOperators(doc, out bson.D, ops bson.D) (bson.D, error) {
+	for _, e := range ops {
+		op := e.Value.(bson.D)[0]
+		v, ok := pathValue(doc, e.Key)
+		items, isArray := v.(bson.A)
+		if !ok || (!isArray && op.Key == "$elemMatch") {
+			out = unsetPath(out, strings.Split(e.Key, "."))
+			continue
+		}
+
+		var err error
+		switch op.Key {
+		case "$slice":
+			if !isArray {
+				break
+			}
+			var sliced bson.A
+			if sliced, err = sliceItems(items, op.Value); err == nil {
+				out, err = setPath(out, strings.Split(e.Key, "."), sliced)
+			}
+
+		case "$elemMatch":
+			cond, isDoc := op.Value.(bson.D)
+			if !isDoc {
+				return nil, toolkit.Errorf("$elemMatch of %s needs a document", e.Key)
+			}
+			out = unsetPath(out, strings.Split(e.Key, "."))
+			for _, item := range items {
+				matched, err := matchElem([]interface{}{bson.A{item}}, cond)
+				if err != nil {
+					return nil, err
+				}
+				if matched {
+					out = setKey(out, e.Key, bson.A{copyValue(item)})
+					break
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// sliceItems is the $slice projection arg of items, n or [skip, limit]
+func sliceItems(items bson.A, arg interface{}) (bson.A, error) {
+	skip, limit := int64(0), int64(len(items))
+	if a, ok := arg.(bson.A); ok {
+		if len(a) != 2 {
+			return nil, toolkit.Errorf("$slice needs a number or [skip, limit]")
+		}
+		var okSkip, okLimit bool
+		skip, okSkip = toInt64(a[0])
+		limit, okLimit = toInt64(a[1])
+		if !okSkip || !okLimit || limit <= 0 {
+			return nil, toolkit.Errorf("$slice needs a number or [skip, limit]")
+		}
+	} else if n, ok := toInt64(arg); !ok {
+		return nil, toolkit.Errorf("$slice needs a number or [skip, limit]")
+	} else if n < 0 {
+		skip, limit = n, -n
+	} else {
+		limit = n
+	}
+
+	size := int64(len(items))
+	if skip < 0 {
+		skip += size
+		if skip < 0 {
+			skip = 0
+		}
+	}
+	if skip > size {
+		skip = size
+	}
+	if skip+limit > size {
+		limit = size - skip
+	}
+	return items[skip : skip+limit], nil
+}
+
+// includePath copies the path parts of src into dst
+func includePath(src, dst bson.D, parts []string) bson.D {
+	value, ok := lookupKey(src, parts[0])
+	if !ok {
+		return dst
+	}
+	if len(parts) == 1 {
+		return setKey(dst, parts[0], value)
+	}
+
+	existing, _ := lookupKey(dst, parts[0])
+	switch x := value.(type) {
+	case bson.D:
+		sub, _ := existing.(bson.D)
+		return setKey(dst, parts[0], includePath(x, sub, parts[1:]))
+	case bson.A:
+		prev, _ := existing.(bson.A)
+		items := bson.A{}
+		for _, item := range x {
+			doc, isDoc := item.(bson.D)
+			if !isDoc {
+				continue
+			}
+			var sub bson.D
+			if len(items) < len(prev) {
+				sub, _ = prev[len(items)].(bson.D)
+			}
+			items = append(items, includePath(doc, sub, parts[1:]))
+		}
+		return setKey(dst, parts[0], items)
+	}
+	return dst
+}
+
+// setKey sets key of doc, keeping its position when it exists
+func setKey(doc bson.D, key string, value interface{}) bson.D {
+	for i, e := range doc {
+		if e.Key == key {
+			doc[i].Value = value
+			return doc
+		}
+	}
+	return append(doc, bson.E{Key: key, Value: value})
+}
+
+// copyDoc returns a deep copy of doc, so updates do not change documents a
+// cursor may still read
+func copyDoc(doc bson.D) bson.D {
+	return copyValue(doc).(bson.D)
+}
+
+func copyValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case bson.D:
+		res := make(bson.D, len(x))
+		for i, e := range x {
+			res[i] = bson.E{Key: e.Key, Value: copyValue(e.Value)}
+		}
+		return res
+	case bson.A:
+		res := make(bson.A, len(x))
+		for i, item := range x {
+			res[i] = copyValue(item)
+		}
+		return res
+	}
+	return v
+}
+
+// setPath sets the dotted path parts of doc, creating the missing documents
+func setPath(doc bson.D, parts []string, value interface{}) (bson.D, error) {
+	if len(parts) == 1 {
+		return setKey(doc, parts[0], value), nil
+	}
+
+	current, ok := lookupKey(doc, parts[0])
+	switch x := current.(type) {
+	case bson.D:
+		sub, err := setPath(x, parts[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		return setKey(doc, parts[0], sub), nil
+	case bson.A:
+		i, err := strconv.Atoi(parts[1])
+		if err != nil || i < 0 {
+			return nil, toolkit.Errorf("cannot create field '%s' in array %s", parts[1], parts[0])
+		}
+		for len(x) <= i {
+			x = append(x, nil)
+		}
+		if len(parts) == 2 {
+			x[i] = value
+		} else {
+			sub, _ := x[i].(bson.D)
+			if x[i], err = setPath(sub, parts[2:], value); err != nil {
+				return nil, err
+			}
+		}
+		return setKey(doc, parts[0], x), nil
+	case nil:
+		if ok && current != nil {
+			break
+		}
+		sub, err := setPath(bson.D{}, parts[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		return setKey(doc, parts[0], sub), nil
+	}
+	return nil, toolkit.Errorf("cannot create field '%s' in element {%s: %v}", parts[1], parts[0], current)
+}
+
+// unsetPath removes the dotted path parts of doc
+func unsetPath(doc bson.D, parts []string) bson.D {
+	for i, e := range doc {
+		if e.Key != parts[0] {
+			continue
+		}
+		if len(parts) == 1 {
+			return append(doc[:i:i], doc[i+1:]...)
+		}
+		switch x := e.Value.(type) {
+		case bson.D:
+			doc[i].Value = unsetPath(x, parts[1:])
+		case bson.A:
+			if n, err := strconv.Atoi(parts[1]); err == nil && n >= 0 && n < len(x) {
+				if len(parts) == 2 {
+					x[n] = nil
+				} else if sub, ok := x[n].(bson.D); ok {
+					x[n] = unsetPath(sub, parts[2:])
+				}
+			}
+		}
+		return doc
+	}
+	return doc
+}
+
+// upsertDoc is the document an upsert starts from, the equality conditions
+// of filter
+func upsertDoc(filter bson.D) bson.D {
+	doc := bson.D{}
+	for _, e := range filter {
+		if strings.HasPrefix(e.Key, "$") {
+			continue
+		}
+		value := e.Value
+		if isOperatorDoc(value) {
+			eq, ok := lookupKey(value.(bson.D), "$eq")
+			if !ok {
+				continue
+			}
+			value = eq
+		}
+		if d, err := setPath(doc, strings.Split(e.Key, "."), value); err == nil {
+			doc = d
+		}
+	}
+	return doc
+}
+
+// applyUpdate returns doc changed by the update operators of update
+func applyUpdate(doc bson.D, update bson.D, insert bool) (bson.D, error) {
+	res := copyDoc(doc)
+	id, hasID := lookupKey(doc, "_id")
+
+	for _, op := range update {
+		fields, ok := op.Value.(bson.D)
+		if !ok {
+			return nil, toolkit.Errorf("modifiers for %s must be an object", op.Key)
+		}
+
+		for _, f := range fields {
+			parts := strings.Split(f.Key, ".")
+			current, exists := pathValue(res, f.Key)
+			var (
+				value interface{}
+				set   = true
+				err   error
+			)
+
+			switch op.Key {
+			case "$set":
+				value = f.Value
+			case "$setOnInsert":
+				value, set = f.Value, insert
+			case "$unset":
+				res, set = unsetPath(res, parts), false
+			case "$inc", "$mul":
+				value, err = arithmetic(op.Key, f.Key, current, exists, f.Value)
+			case "$min", "$max":
+				value = f.Value
+				if exists {
+					c := compareValues(f.Value, current)
+					set = (op.Key == "$min" && c < 0) || (op.Key == "$max" && c > 0)
+				}
+			case "$push", "$addToSet":
+				value, err = pushValues(op.Key, f.Key, current, exists, f.Value)
+			case "$pull":
+				value, set, err = pullValues(f.Key, current, exists, f.Value)
+			case "$rename":
+				name, isString := f.Value.(string)
+				if !isString {
+					return nil, toolkit.Errorf("the 'to' field for $rename must be a string")
+				}
+				set = false
+				if exists {
+					res = unsetPath(res, parts)
+					res, err = setPath(res, strings.Split(name, "."), current)
+				}
+			case "$currentDate":
+				value = primitive.NewDateTimeFromTime(time.Now())
+			default:
+				return nil, toolkit.Errorf("update operator %s is not supported by mongomem", op.Key)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if set {
+				if res, err = setPath(res, parts, value); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if newID, ok := lookupKey(res, "_id"); hasID && (!ok || compareValues(id, newID) != 0) {
+		return nil, toolkit.Errorf("performing an update on the path '_id' would modify the immutable field '_id'")
+	}
+	return res, nil
+}
+
+func arithmetic(op, field string, current interface{}, exists bool, arg interface{}) (interface{}, error) {
+	if _, ok := number(arg); !ok {
+		return nil, toolkit.Errorf("cannot %s with non-numeric argument: {%s: %v}", op[1:], field, arg)
+	}
+	if !exists {
+		if op == "$mul" {
+			current = int32(0)
+		} else {
+			return arg, nil
+		}
+	}
+	if _, ok := number(current); !ok {
+		return nil, toolkit.Errorf("cannot apply %s to a value of non-numeric type for %s", op, field)
+	}
+
+	a, aInt := toInt64(current)
+	b, bInt := toInt64(arg)
+	if aInt && bInt {
+		n := a + b
+		if op == "$mul" {
+			n = a * b
+		}
+		_, aLong := current.(int64)
+		_, bLong := arg.(int64)
+		if !aLong && !bLong && n >= math.MinInt32 && n <= math.MaxInt32 {
+			return int32(n), nil
+		}
+		return n, nil
+	}
+	fa, _ := number(current)
+	fb, _ := number(arg)
+	if op == "$mul" {
+		return fa * fb, nil
+	}
+	return fa + fb, nil
+}
+
+func pushValues(op, field string, current interface{}, exists bool, arg interface{}) (interface{}, error) {
+	items := bson.A{}
+	if exists {
+		a, ok := current.(bson.A)
+		if !ok {
+			return nil, toolkit.Errorf("the field '%s' must be an array to apply %s", field, op)
+		}
+		items = append(items, a...)
+	}
+
+	values := bson.A{arg}
+	if d, ok := arg.(bson.D); ok {
+		if each, has := lookupKey(d, "$each"); has {
+			if values, ok = each.(bson.A); !ok {
+				return nil, toolkit.Errorf("the argument to $each in %s must be an array", op)
+			}
+		}
+	}
+	for _, v := range values {
+		if op == "$addToSet" && containsValue(items, v) {
+			continue
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
+
+func containsValue(items bson.A, v interface{}) bool {
+	for _, item := range items {
+		if compareValues(item, v) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func pullValues(field string, current interface{}, exists bool, cond interface{}) (interface{}, bool, error) {
+	if !exists {
+		return nil, false, nil
+	}
+	a, ok := current.(bson.A)
+	if !ok {
+		return nil, false, toolkit.Errorf("cannot apply $pull to a non-array value for %s", field)
+	}
+
+	items := bson.A{}
+	for _, item := range a {
+		var matched bool
+		var err error
+		if doc, isDoc := item.(bson.D); isDoc && !isOperatorDoc(cond) {
+			if c, isCond := cond.(bson.D); isCond {
+				matched, err = matchDoc(doc, c)
+			}
+		} else {
+			matched, err = matchField([]interface{}{item}, cond)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if !matched {
+			items = append(items, item)
+		}
+	}
+	return items, true, nil
+}
+
+// aggregateDocs runs the stages of an aggregation pipeline on docs
+func aggregateDocs(docs []bson.D, stages []bson.D) ([]bson.D, error) {
+	for _, stage := range stages {
+		if len(stage) != 1 {
+			return nil, toolkit.Errorf("a pipeline stage specification object must contain exactly one field")
+		}
+		name, arg := stage[0].Key, stage[0].Value
+
+		var err error
+		switch name {
+		case "$match":
+			filter, ok := arg.(bson.D)
+			if !ok {
+				return nil, toolkit.Errorf("the match filter must be an expression in an object")
+			}
+			matched := []bson.D{}
+			for _, doc := range docs {
+				ok, err := matchDoc(doc, filter)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					matched = append(matched, doc)
+				}
+			}
+			docs = matched
+		case "$group":
+			spec, ok := arg.(bson.D)
+			if !ok {
+				return nil, toolkit.Errorf("a group's fields must be specified in an object")
+			}
+			docs, err = groupDocs(docs, spec)
+		case "$sort":
+			spec, ok := arg.(bson.D)
+			if !ok {
+				return nil, toolkit.Errorf("the $sort key specification must be an object")
+			}
+			docs, err = sortDocs(docs, spec)
+		case "$skip", "$limit":
+			n, ok := number(arg)
+			if !ok || n < 0 {
+				return nil, toolkit.Errorf("%s needs a positive number", name)
+			}
+			if name == "$skip" {
+				docs = skipLimit(docs, int64(n), 0)
+			} else {
+				docs = skipLimit(docs, 0, int64(n))
+			}
+		case "$project":
+			spec, ok := arg.(bson.D)
+			if !ok {
+				return nil, toolkit.Errorf("$project specification must be an object")
+			}
+			docs, err = projectStage(docs, spec)
+		case "$count":
+			field, ok := arg.(string)
+			if !ok || field == "" {
+				return nil, toolkit.Errorf("the count field must be a non-empty string")
+			}
+			if len(docs) == 0 {
+				docs = []bson.D{}
+			} else {
+				docs = []bson.D{{{Key: field, Value: int32(len(docs))}}}
+			}
+		case "$unwind":
+			docs, err = unwindDocs(docs, arg)
+		default:
+			return nil, toolkit.Errorf("stage %s is not supported by mongomem", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// evalExpr evaluates an aggregation expression, a "$field" reference, a
+// document of expressions or a literal
+func evalExpr(doc bson.D, expr interface{}) (interface{}, error) {
+	switch x := expr.(type) {
+	case string:
+		if strings.HasPrefix(x, "$") {
+			v, _ := pathValue(doc, x[1:])
+			return v, nil
+		}
+	case bson.D:
+		if isOperatorDoc(x) {
+			if x[0].Key == "$literal" {
+				return x[0].Value, nil
+			}
+			return nil, toolkit.Errorf("expression %s is not supported by mongomem", x[0].Key)
+		}
+		res := bson.D{}
+		for _, e := range x {
+			v, err := evalExpr(doc, e.Value)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, bson.E{Key: e.Key, Value: v})
+		}
+		return res, nil
+	}
+	return expr, nil
+}
+
+type group struct {
+	id     interface{}
+	values map[string][]interface{}
+}
+
+func groupDocs(docs []bson.D, spec bson.D) ([]bson.D, error) {
+	idExpr, ok := lookupKey(spec, "_id")
+	if !ok {
+		return nil, toolkit.Errorf("a group specification must include an _id")
+	}
+
+	type accumulator struct {
+		field, op string
+		expr      interface{}
+	}
+	accs := []accumulator{}
+	for _, e := range spec {
+		if e.Key == "_id" {
+			continue
+		}
+		d, ok := e.Value.(bson.D)
+		if !ok || len(d) != 1 {
+			return nil, toolkit.Errorf("the field '%s' must be an accumulator object", e.Key)
+		}
+		switch d[0].Key {
+		case "$sum", "$avg", "$min", "$max", "$first", "$last", "$push", "$addToSet", "$count":
+		default:
+			return nil, toolkit.Errorf("accumulator %s is not supported by mongomem", d[0].Key)
+		}
+		accs = append(accs, accumulator{e.Key, d[0].Key, d[0].Value})
+	}
+
+	groups := []*group{}
+	for _, doc := range docs {
+		id, err := evalExpr(doc, idExpr)
+		if err != nil {
+			return nil, err
+		}
+		var g *group
+		for _, existing := range groups {
+			if compareValues(existing.id, id) == 0 {
+				g = existing
+				break
+			}
+		}
+		if g == nil {
+			g = &group{id: id, values: map[string][]interface{}{}}
+			groups = append(groups, g)
+		}
+
+		for _, acc := range accs {
+			var v interface{} = int32(1)
+			if acc.op != "$count" {
+				if v, err = evalExpr(doc, acc.expr); err != nil {
+					return nil, err
+				}
+			}
+			g.values[acc.field] = append(g.values[acc.field], v)
+		}
+	}
+
+	res := []bson.D{}
+	for _, g := range groups {
+		out := bson.D{{Key: "_id", Value: g.id}}
+		for _, acc := range accs {
+			out = append(out, bson.E{Key: acc.field, Value: accumulate(acc.op, g.values[acc.field])})
+		}
+		res = append(res, out)
+	}
+	return res, nil
+}
+
+func accumulate(op string, values []interface{}) interface{} {
+	switch op {
+	case "$sum", "$count":
+		var (
+			total   int64
+			ftotal  float64
+			isFloat bool
+			isLong  bool
+		)
+		for _, v := range values {
+			switch x := v.(type) {
+			case int32:
+				total += int64(x)
+			case int64:
+				total += x
+				isLong = true
+			default:
+				if f, ok := number(v); ok {
+					ftotal += f
+					isFloat = true
+				}
+			}
+		}
+		if isFloat {
+			return ftotal + float64(total)
+		}
+		if !isLong && total >= math.MinInt32 && total <= math.MaxInt32 {
+			return int32(total)
+		}
+		return total
+
+	case "$avg":
+		total, n := 0.0, 0
+		for _, v := range values {
+			if f, ok := number(v); ok {
+				total += f
+				n++
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+		return total / float64(n)
+
+	case "$min", "$max":
+		var res interface{}
+		for _, v := range values {
+			if v == nil {
+				continue
+			}
+			if res == nil {
+				res = v
+				continue
+			}
+			c := compareValues(v, res)
+			if (op == "$min" && c < 0) || (op == "$max" && c > 0) {
+				res = v
+			}
+		}
+		return res
+
+	case "$first":
+		if len(values) > 0 {
+			return values[0]
+		}
+	case "$last":
+		if len(values) > 0 {
+			return values[len(values)-1]
+		}
+
+	case "$push":
+		res := bson.A{}
+		for _, v := range values {
+			if v != nil {
+				res = append(res, v)
+			}
+		}
+		return res
+	case "$addToSet":
+		res := bson.A{}
+		for _, v := range values {
+			if v != nil && !containsValue(res, v) {
+				res = append(res, v)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+// projectStage runs a $project stage, a find projection where a field can
+// also be set from an expression
+func projectStage(docs []bson.D, spec bson.D) ([]bson.D, error) {
+	plain := bson.D{}
+	computed := bson.D{}
+	for _, e := range spec {
+		switch e.Value.(type) {
+		case string, bson.D:
+			computed = append(computed, e)
+		default:
+			plain = append(plain, e)
+		}
+	}
+	if len(computed) == 0 {
+		return projectDocs(docs, plain)
+	}
+
+	idIncluded := true
+	for _, e := range plain {
+		if e.Key == "_id" {
+			idIncluded = truthy(e.Value)
+		} else if !truthy(e.Value) {
+			return nil, toolkit.Errorf("cannot do exclusion on field %s in inclusion projection", e.Key)
+		}
+	}
+
+	res := make([]bson.D, len(docs))
+	for i, doc := range docs {
+		out := bson.D{}
+		if id, ok := lookupKey(doc, "_id"); ok && idIncluded {
+			out = append(out, bson.E{Key: "_id", Value: id})
+		}
+		for _, e := range plain {
+			if e.Key != "_id" {
+				out = includePath(doc, out, strings.Split(e.Key, "."))
+			}
+		}
+		for _, e := range computed {
+			v, err := evalExpr(doc, e.Value)
+			if err != nil {
+				return nil, err
+			}
+			if out, err = setPath(out, strings.Split(e.Key, "."), v); err != nil {
+				return nil, err
+			}
+		}
+		res[i] = out
+	}
+	return res, nil
+}
+
+func unwindDocs(docs []bson.D, arg interface{}) ([]bson.D, error) {
+	path, preserve := "", false
+	switch x := arg.(type) {
+	case string:
+		path = x
+	case bson.D:
+		p, _ := lookupKey(x, "path")
+		path, _ = p.(string)
+		v, _ := lookupKey(x, "preserveNullAndEmptyArrays")
+		preserve = truthy(v)
+	}
+	if !strings.HasPrefix(path, "$") {
+		return nil, toolkit.Errorf("$unwind path should be a field path starting with '$'")
+	}
+	path = path[1:]
+
+	res := []bson.D{}
+	for _, doc := range docs {
+		v, ok := pathValue(doc, path)
+		a, isArray := v.(bson.A)
+		switch {
+		case isArray && len(a) > 0:
+			for _, item := range a {
+				out, err := setPath(copyDoc(doc), strings.Split(path, "."), item)
+				if err != nil {
+					return nil, err
+				}
+				res = append(res, out)
+			}
+		case ok && v != nil && !isArray:
+			res = append(res, doc)
+		case preserve:
+			res = append(res, doc)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,364 @@
+package flexmgo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.eaciitapp.com/sebar/dbflex"
+	"github.com/eaciit/toolkit"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const (
+	// KeyCommandLogLevel is the config key of the level commands are logged
+	// at when they succeed: off, debug, info, warning or error. Default off.
+	KeyCommandLogLevel = "commandLogLevel"
+	// KeyFailureLogLevel is the config key of the level failed commands are
+	// logged at, default warning
+	KeyFailureLogLevel = "failureLogLevel"
+	// KeySlowQueryThreshold is the config key of the duration, in ms, above
+	// which a command is logged as slow with its redacted filter. Default 0,
+	// slow commands are not logged.
+	KeySlowQueryThreshold = "slowQueryThreshold"
+	// KeySlowQueryLogLevel is the config key of the level slow commands are
+	// logged at, default warning
+	KeySlowQueryLogLevel = "slowQueryLogLevel"
+	// KeyCommandObserver is the config key of a CommandObserver, or a
+	// func(CommandEvent), receiving every finished command
+	KeyCommandObserver = "commandObserver"
+)
+
+// monitorOptions are config keys read by commandMonitor and tracer
+var monitorOptions = map[string]bool{
+	"commandloglevel":    true,
+	"failureloglevel":    true,
+	"slowquerythreshold": true,
+	"slowqueryloglevel":  true,
+	"commandobserver":    true,
+	"tracerprovider":     true,
+}
+
+var logLevels = map[string]bool{
+	"off": true, "debug": true, "info": true, "warning": true, "error": true,
+}
+
+// CommandEvent describes a command once the server replied to it
+type CommandEvent struct {
+	Name       string
+	Database   string
+	Collection string
+	Connection string
+	Duration   time.Duration
+	// Failure is the error message of a failed command, empty on success
+	Failure string
+}
+
+// CommandObserver receives every finished command of the connection it is
+// set on with the commandObserver config key. It is called from the driver
+// goroutines so it should be quick and safe for concurrent use.
+type CommandObserver interface {
+	ObserveCommand(CommandEvent)
+}
+
+// CommandObserverFunc makes a func a CommandObserver
+type CommandObserverFunc func(CommandEvent)
+
+func (fn CommandObserverFunc) ObserveCommand(e CommandEvent) {
+	fn(e)
+}
+
+// commandMonitor logs and observes the commands sent by the client
+type commandMonitor struct {
+	commandLevel  string
+	failureLevel  string
+	slowLevel     string
+	slowThreshold time.Duration
+	observer      CommandObserver
+
+	started sync.Map
+}
+
+// startedCommand is what is kept of a command until it finishes
+type startedCommand struct {
+	collection string
+	command    bson.Raw
+}
+
+// commandMonitor returns the monitor configured by the connection config,
+// it is nil when nothing is logged nor observed
+func (c *Connection) commandMonitor() (*commandMonitor, error) {
+	m := &commandMonitor{commandLevel: "off", failureLevel: "warning", slowLevel: "warning"}
+
+	levels := []struct {
+		key   string
+		level *string
+	}{
+		{KeyCommandLogLevel, &m.commandLevel},
+		{KeyFailureLogLevel, &m.failureLevel},
+		{KeySlowQueryLogLevel, &m.slowLevel},
+	}
+	for _, l := range levels {
+		if v := strings.ToLower(c.configString(l.key)); v != "" {
+			if !logLevels[v] {
+				return nil, toolkit.Errorf("invalid %s %s", l.key, v)
+			}
+			*l.level = v
+		}
+	}
+
+	var err error
+	if v := c.configValue(KeySlowQueryThreshold); v != nil {
+		if m.slowThreshold, err = configDuration(v, time.Millisecond); err != nil {
+			return nil, toolkit.Errorf("invalid %s. %s", KeySlowQueryThreshold, err.Error())
+		}
+	}
+
+	switch o := c.configValue(KeyCommandObserver).(type) {
+	case nil:
+	case CommandObserver:
+		m.observer = o
+	case func(CommandEvent):
+		m.observer = CommandObserverFunc(o)
+	default:
+		return nil, toolkit.Errorf("invalid %s %T, it should be a CommandObserver", KeyCommandObserver, o)
+	}
+
+	if m.commandLevel == "off" && m.failureLevel == "off" && m.slowThreshold == 0 && m.observer == nil {
+		return nil, nil
+	}
+	return m, nil
+}
+
+func (m *commandMonitor) eventMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: m.commandStarted,
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			m.commandFinished(ctx, e.CommandFinishedEvent, "")
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			m.commandFinished(ctx, e.CommandFinishedEvent, e.Failure)
+		},
+	}
+}
+
+func (m *commandMonitor) commandStarted(ctx context.Context, e *event.CommandStartedEvent) {
+	sc := startedCommand{}
+	if v, err := e.Command.LookupErr(e.CommandName); err == nil && v.Type == bsontype.String {
+		sc.collection = v.StringValue()
+	}
+	if m.slowThreshold > 0 {
+		//-- the event buffer may be reused once the command is sent
+		sc.command = append(bson.Raw(nil), e.Command...)
+	}
+	m.started.Store(e.RequestID, sc)
+}
+
+func (m *commandMonitor) commandFinished(ctx context.Context, e event.CommandFinishedEvent, failure string) {
+	sc := startedCommand{}
+	if v, ok := m.started.Load(e.RequestID); ok {
+		sc = v.(startedCommand)
+		m.started.Delete(e.RequestID)
+	}
+
+	ns := e.DatabaseName
+	if sc.collection != "" {
+		ns += "." + sc.collection
+	}
+
+	switch {
+	case failure != "":
+		logAt(m.failureLevel, "command %s on %s failed after %s. %s", e.CommandName, ns, e.Duration, failure)
+	case m.slowThreshold > 0 && e.Duration >= m.slowThreshold:
+		logAt(m.slowLevel, "slow command %s on %s took %s. %s", e.CommandName, ns, e.Duration, redactCommand(e.CommandName, sc.command))
+	default:
+		logAt(m.commandLevel, "command %s on %s took %s", e.CommandName, ns, e.Duration)
+	}
+
+	if m.observer != nil {
+		m.observer.ObserveCommand(CommandEvent{
+			Name:       e.CommandName,
+			Database:   e.DatabaseName,
+			Collection: sc.collection,
+			Connection: e.ConnectionID,
+			Duration:   e.Duration,
+			Failure:    failure,
+		})
+	}
+}
+
+func logAt(level, format string, args ...interface{}) {
+	switch level {
+	case "debug":
+		dbflex.Logger().Debugf(format, args...)
+	case "info":
+		dbflex.Logger().Infof(format, args...)
+	case "warning":
+		dbflex.Logger().Warningf(format, args...)
+	case "error":
+		dbflex.Logger().Errorf(format, args...)
+	}
+}
+
+// redactedFields are the parts of a command written to the slow command log.
+// Filters keep their fields and operators but not their values, documents
+// being written are left out.
+var redactedFields = map[string]bool{
+	"filter":   true,
+	"query":    true,
+	"q":        true,
+	"pipeline": true,
+	"updates":  true,
+	"deletes":  true,
+	"sort":     true,
+	"key":      true,
+}
+
+// redactCommand writes the shape of cmd, with every value replaced by "?"
+func redactCommand(name string, cmd bson.Raw) string {
+	if len(cmd) == 0 {
+		return "{}"
+	}
+
+	elems, err := cmd.Elements()
+	if err != nil {
+		return "{}"
+	}
+	parts := []string{}
+	for _, e := range elems {
+		key := e.Key()
+		switch {
+		case key == name:
+			parts = append(parts, fmt.Sprintf("%q: %s", key, e.Value().String()))
+		case redactedFields[key]:
+			parts = append(parts, fmt.Sprintf("%q: %s", key, redactValue(key, e.Value())))
+		}
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// redactDocument writes the shape of a filter or command document like
+// redactCommand does
+func redactDocument(doc interface{}) string {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return ""
+	}
+	return redactValue("filter", bson.RawValue{Type: bsontype.EmbeddedDocument, Value: raw})
+}
+
+func redactValue(key string, v bson.RawValue) string {
+	switch v.Type {
+	case bsontype.EmbeddedDocument:
+		elems, err := v.Document().Elements()
+		if err != nil {
+			return `"?"`
+		}
+		parts := []string{}
+		for _, e := range elems {
+			if key == "updates" && e.Key() == "u" {
+				//-- the new values of an update are data, not filter
+				parts = append(parts, `"u": "?"`)
+				continue
+			}
+			parts = append(parts, fmt.Sprintf("%q: %s", e.Key(), redactValue(key, e.Value())))
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+
+	case bsontype.Array:
+		values, err := v.Array().Values()
+		if err != nil {
+			return `"?"`
+		}
+		parts := []string{}
+		for _, item := range values {
+			if item.Type != bsontype.EmbeddedDocument && item.Type != bsontype.Array {
+				//-- a list of values, like the one of $in, is one "?"
+				return `["?"]`
+			}
+			parts = append(parts, redactValue(key, item))
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	}
+
+	if key == "sort" {
+		//-- sort directions are not data
+		return v.String()
+	}
+	return `"?"`
+}
+
+// CommandStats is a CommandObserver counting commands and their latency by
+// command name, for example to export them as metrics
+type CommandStats struct {
+	mtx     sync.Mutex
+	buckets []time.Duration
+	stats   map[string]*CommandStat
+}
+
+// CommandStat are the counters of one command name. Counts[i] is the number
+// of commands that took up to Buckets[i], the last count is for the ones
+// that took longer than the last bucket.
+type CommandStat struct {
+	Count    int64
+	Failures int64
+	Total    time.Duration
+	Buckets  []time.Duration
+	Counts   []int64
+}
+
+// DefaultLatencyBuckets are the histogram buckets of NewCommandStats when
+// none is given
+var DefaultLatencyBuckets = []time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// NewCommandStats creates a CommandStats with the given latency buckets, or
+// DefaultLatencyBuckets
+func NewCommandStats(buckets ...time.Duration) *CommandStats {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	sorted := append([]time.Duration{}, buckets...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return &CommandStats{buckets: sorted, stats: map[string]*CommandStat{}}
+}
+
+func (s *CommandStats) ObserveCommand(e CommandEvent) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	st, ok := s.stats[e.Name]
+	if !ok {
+		st = &CommandStat{Buckets: s.buckets, Counts: make([]int64, len(s.buckets)+1)}
+		s.stats[e.Name] = st
+	}
+	st.Count++
+	st.Total += e.Duration
+	if e.Failure != "" {
+		st.Failures++
+	}
+	st.Counts[sort.Search(len(s.buckets), func(i int) bool { return e.Duration <= s.buckets[i] })]++
+}
+
+// Snapshot returns a copy of the counters keyed by command name
+func (s *CommandStats) Snapshot() map[string]CommandStat {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	res := make(map[string]CommandStat, len(s.stats))
+	for name, st := range s.stats {
+		cp := *st
+		cp.Counts = append([]int64{}, st.Counts...)
+		res[name] = cp
+	}
+	return res
+}
@@ -0,0 +1,137 @@
+package flexmgo
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"git.eaciitapp.com/sebar/dbflex"
+	"github.com/eaciit/toolkit"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ObjTypeGridFS is the object type of GridFS buckets. A bucket is reported
+// once by its name, not as its .files and .chunks collections.
+const ObjTypeGridFS dbflex.ObjTypeEnum = "gridfs"
+
+// ObjectNames returns the names of the objects of type ot in the database.
+// Errors are logged and give an empty list, use ListObjects to get them.
+func (c *Connection) ObjectNames(ot dbflex.ObjTypeEnum) []string {
+	names, err := c.ListObjects(ot, "")
+	if err != nil {
+		dbflex.Logger().Errorf("unable to list objects. %s", err.Error())
+		return []string{}
+	}
+	return names
+}
+
+// ListObjects returns the sorted names of the objects of type ot whose name
+// matches pattern. Pattern uses the path.Match syntax, for example "order*",
+// an empty pattern matches every name. Collections, timeseries collections
+// and GridFS buckets are tables, ObjTypeView lists views and ObjTypeGridFS
+// only GridFS buckets. System collections are left out. A pattern written as
+// database:pattern lists another database than the one of the server info.
+func (c *Connection) ListObjects(ot dbflex.ObjTypeEnum, pattern string) ([]string, error) {
+	database, pattern := c.splitTable(pattern, "")
+	if pattern != "" {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, toolkit.Errorf("invalid name pattern %s. %s", pattern, err.Error())
+		}
+	}
+
+	collections, views, err := c.listCollections(database)
+	if err != nil {
+		return nil, err
+	}
+
+	//-- a files and chunks pair is one GridFS bucket
+	tables, buckets := []string{}, []string{}
+	for name := range collections {
+		if strings.HasSuffix(name, ".files") {
+			bucket := strings.TrimSuffix(name, ".files")
+			if collections[bucket+".chunks"] {
+				buckets = append(buckets, bucket)
+				continue
+			}
+		}
+		if strings.HasSuffix(name, ".chunks") && collections[strings.TrimSuffix(name, ".chunks")+".files"] {
+			continue
+		}
+		tables = append(tables, name)
+	}
+
+	var names []string
+	switch ot {
+	case dbflex.ObjTypeTable:
+		names = append(tables, buckets...)
+	case dbflex.ObjTypeView:
+		names = views
+	case ObjTypeGridFS:
+		names = buckets
+	case dbflex.ObjTypeAll:
+		names = append(append(tables, buckets...), views...)
+	default:
+		names = []string{}
+	}
+
+	matched := []string{}
+	for _, name := range names {
+		if ok, _ := path.Match(pattern, name); pattern == "" || ok {
+			matched = append(matched, name)
+		}
+	}
+	sort.Strings(matched)
+	return matched, nil
+}
+
+// listCollections returns the collections and the views of database, system
+// collections are left out
+func (c *Connection) listCollections(database string) (map[string]bool, []string, error) {
+	if database == "" {
+		return nil, nil, toolkit.Errorf("no database selected")
+	}
+	if c.mem != nil {
+		collections := map[string]bool{}
+		for _, name := range c.mem.collectionNames(database) {
+			collections[name] = true
+		}
+		return collections, []string{}, nil
+	}
+
+	client := c.Client()
+	if client == nil {
+		return nil, nil, toolkit.Errorf("connection is not connected")
+	}
+	db := client.Database(database)
+
+	cur, err := db.ListCollections(c.Context(), bson.M{})
+	if err != nil {
+		return nil, nil, toolkit.Errorf("unable to list collections. %s", err.Error())
+	}
+	defer cur.Close(c.Context())
+
+	collections := map[string]bool{}
+	views := []string{}
+	for cur.Next(c.Context()) {
+		spec := struct {
+			Name string `bson:"name"`
+			Type string `bson:"type"`
+		}{}
+		if err = cur.Decode(&spec); err != nil {
+			return nil, nil, toolkit.Errorf("unable to decode collection info. %s", err.Error())
+		}
+		if strings.HasPrefix(spec.Name, "system.") {
+			continue
+		}
+
+		if spec.Type == "view" {
+			views = append(views, spec.Name)
+		} else {
+			collections[spec.Name] = true
+		}
+	}
+	if err = cur.Err(); err != nil {
+		return nil, nil, toolkit.Errorf("unable to list collections. %s", err.Error())
+	}
+	return collections, views, nil
+}
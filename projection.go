@@ -0,0 +1,175 @@
+package flexmgo
+
+import (
+	"strings"
+
+	df "git.eaciitapp.com/sebar/dbflex"
+	"github.com/eaciit/toolkit"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// KeyProjection is the cursor parameter, or query config, key of the
+// Projection items added to the selected fields of a find
+const KeyProjection = "projection"
+
+// Projection is a projection of a field other than including or excluding
+// it, like the first items of an array. See ProjectSlice, ProjectSliceRange
+// and ProjectElemMatch.
+type Projection struct {
+	Field string
+	slice []int
+	match *df.Filter
+}
+
+// ProjectSlice returns the first n items of the array field, or the last
+// ones when n is negative
+func ProjectSlice(field string, n int) Projection {
+	return Projection{Field: field, slice: []int{n}}
+}
+
+// ProjectSliceRange returns limit items of the array field after skipping
+// skip of them, a negative skip counts from the end
+func ProjectSliceRange(field string, skip, limit int) Projection {
+	return Projection{Field: field, slice: []int{skip, limit}}
+}
+
+// ProjectElemMatch returns only the first item of the array field matching
+// all of filters, see ElemMatch
+func ProjectElemMatch(field string, filters ...*df.Filter) Projection {
+	return Projection{Field: field, match: ElemMatch(field, filters...)}
+}
+
+// sortDoc turns the keys of OrderBy into a sort document, in order. A key
+// starting with "-" is descending.
+func sortDoc(keys []string) (bson.D, error) {
+	sort := bson.D{}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		field, dir := fieldOf(key)
+		if field == "" {
+			return nil, toolkit.Errorf("invalid sort key %q", key)
+		}
+		if seen[field] {
+			return nil, toolkit.Errorf("sort key %s is given twice", field)
+		}
+		seen[field] = true
+		sort = append(sort, bson.E{Key: field, Value: dir})
+	}
+	return sort, nil
+}
+
+// projectionDoc turns the fields of Select into a projection document. A
+// field starting with "-" is excluded, the others are included. Only _id
+// can be excluded from a projection including fields.
+func projectionDoc(fields []string) (bson.D, error) {
+	projection := bson.D{}
+	include, exclude := "", ""
+	for _, f := range fields {
+		field, dir := fieldOf(f)
+		if field == "" {
+			return nil, toolkit.Errorf("invalid field %q", f)
+		}
+		if dir < 0 {
+			projection = append(projection, bson.E{Key: field, Value: 0})
+			if field != "_id" {
+				exclude = field
+			}
+		} else {
+			projection = append(projection, bson.E{Key: field, Value: 1})
+			include = field
+		}
+	}
+	if include != "" && exclude != "" {
+		return nil, toolkit.Errorf("can not exclude %s when including %s", exclude, include)
+	}
+	return projection, nil
+}
+
+// fieldOf splits key into its field and its direction, -1 when it starts
+// with "-"
+func fieldOf(key string) (string, int) {
+	key = strings.TrimSpace(key)
+	if strings.HasPrefix(key, "-") {
+		return strings.TrimSpace(key[1:]), -1
+	}
+	return strings.TrimPrefix(key, "+"), 1
+}
+
+// projections adds the Projection items under KeyProjection to projection
+func (q *Query) projections(m toolkit.M, projection bson.D) (bson.D, error) {
+	var items []Projection
+	switch v := q.setting(m, KeyProjection).(type) {
+	case nil:
+		return projection, nil
+	case Projection:
+		items = []Projection{v}
+	case []Projection:
+		items = v
+	default:
+		return nil, toolkit.Errorf("invalid %s %T, it should be a list of Projection", KeyProjection, v)
+	}
+
+	for _, p := range items {
+		if p.Field == "" {
+			return nil, toolkit.Errorf("projection needs a field")
+		}
+		switch {
+		case len(p.slice) == 1:
+			projection = append(projection, bson.E{Key: p.Field, Value: bson.M{"$slice": p.slice[0]}})
+		case len(p.slice) == 2:
+			if p.slice[1] <= 0 {
+				return nil, toolkit.Errorf("slice of %s needs a positive limit", p.Field)
+			}
+			projection = append(projection, bson.E{Key: p.Field, Value: bson.M{"$slice": p.slice}})
+		case p.match != nil:
+			if err := checkFilter(p.match); err != nil {
+				return nil, err
+			}
+			match, err := q.elemMatch(p.match)
+			if err != nil {
+				return nil, err
+			}
+			projection = append(projection, bson.E{Key: p.Field, Value: bson.M{"$elemMatch": match}})
+		default:
+			return nil, toolkit.Errorf("projection of %s has nothing to project", p.Field)
+		}
+	}
+	return projection, nil
+}
+
+// findDocs builds the projection and the sort of a find from the selected
+// fields, the Projection items and the order by keys of the command, with
+// the text score when KeyTextScore is set
+func (q *Query) findDocs(m toolkit.M, parts df.GroupedQueryItems) (bson.D, bson.D, error) {
+	projection, sort := bson.D{}, bson.D{}
+	var err error
+	if items, ok := parts[df.QuerySelect]; ok {
+		if projection, err = projectionDoc(items[0].Value.([]string)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if projection, err = q.projections(m, projection); err != nil {
+		return nil, nil, err
+	}
+	if items, ok := parts[df.QueryOrder]; ok {
+		if sort, err = sortDoc(items[0].Value.([]string)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if score, ok := q.setting(m, KeyTextScore).(string); ok && score != "" {
+		projection = textScoreProjection(projection, score)
+		sort = textScoreSort(sort, score)
+	}
+	return projection, sort, nil
+}
+
+// inclusion tells whether projection includes fields, rather than
+// excluding them
+func inclusion(projection bson.D) bool {
+	for _, e := range projection {
+		if e.Key != "_id" && e.Value == 1 {
+			return true
+		}
+	}
+	return false
+}
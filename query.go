@@ -1,6 +1,7 @@
 package flexmgo
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"strings"
@@ -13,9 +14,9 @@ import (
 
 	"bufio"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -23,41 +24,28 @@ type Query struct {
 	dbflex.QueryBase
 }
 
+// BuildCommand returns the command document of the query, see Command
 func (q *Query) BuildCommand() (interface{}, error) {
-	return nil, nil
+	cmd, err := q.Command(nil)
+	if err != nil || cmd == nil {
+		return nil, err
+	}
+	return cmd, nil
 }
 
 func (q *Query) BuildFilter(f *df.Filter) (interface{}, error) {
+	if err := checkFilter(f); err != nil {
+		return nil, err
+	}
+
 	fm := M{}
 	if f.Op == df.OpEq {
 		fm.Set(f.Field, M{}.Set("$eq", f.Value))
 	} else if f.Op == df.OpNe {
 		fm.Set(f.Field, M{}.Set("$ne", f.Value))
-	} else if f.Op == df.OpContains {
-		fs := f.Value.([]string)
-		if len(fs) > 1 {
-			bfs := []interface{}{}
-			for _, ff := range fs {
-				pfm := M{}
-				pfm.Set(f.Field, M{}.
-					Set("$regex", fmt.Sprintf(".*%s.*", ff)).
-					Set("$options", "i"))
-				bfs = append(bfs, pfm)
-			}
-			fm.Set("$or", bfs)
-		} else {
-			fm.Set(f.Field, M{}.
-				Set("$regex", fmt.Sprintf(".*%s.*", fs[0])).
-				Set("$options", "i"))
-		}
-	} else if f.Op == df.OpStartWith {
-		fm.Set(f.Field, M{}.
-			Set("$regex", fmt.Sprintf("^%s.*$", f.Value)).
-			Set("$options", "i"))
-	} else if f.Op == df.OpEndWith {
-		fm.Set(f.Field, M{}.
-			Set("$regex", fmt.Sprintf("^.*%s$", f.Value)).
-			Set("$options", "i"))
+	} else if f.Op == df.OpContains || f.Op == df.OpStartWith || f.Op == df.OpEndWith ||
+		f.Op == OpContainsCase || f.Op == OpStartWithCase || f.Op == OpEndWithCase || f.Op == OpRegex {
+		return regexFilter(f)
 	} else if f.Op == df.OpIn {
 		fm.Set(f.Field, M{}.Set("$in", f.Value))
 	} else if f.Op == df.OpNin {
@@ -77,95 +65,173 @@ func (q *Query) BuildFilter(f *df.Filter) (interface{}, error) {
 		fand := dbflex.And(bfs...)
 		return q.BuildFilter(fand)
 	} else if f.Op == df.OpOr || f.Op == df.OpAnd {
-		bfs := []interface{}{}
-		fs := f.Items
-		for _, ff := range fs {
-			bf, eb := q.BuildFilter(ff)
-			if eb == nil {
-				bfs = append(bfs, bf)
-			}
-		}
-
-		fm.Set(string(f.Op), bfs)
+		return q.itemsFilter(f)
 	} else if f.Op == df.OpNot {
-		bf, eb := q.BuildFilter(f.Items[0])
-		if eb == nil {
-			field := f.Items[0].Field
-			fm.Set(field, M{}.Set("$not", bf.(M).Get(field)))
-		}
+		return q.notFilter(f)
+	} else if f.Op == OpExists || f.Op == OpType || f.Op == OpSize || f.Op == OpAll ||
+		f.Op == OpElemMatch || f.Op == OpMod || f.Op == OpIsNull || f.Op == OpIsNotNull {
+		return q.operatorFilter(f)
+	} else if f.Op == OpNear || f.Op == OpNearSphere || f.Op == OpGeoWithin || f.Op == OpGeoIntersects {
+		return geoFilter(f)
+	} else if f.Op == OpText {
+		return textFilter(f)
 	} else {
 		return nil, fmt.Errorf("Filter Op %s is not defined", f.Op)
 	}
 	return fm, nil
 }
 
+// context returns the context given in m under KeyContext, or the connection
+// context if there is none. It joins the transaction of the connection.
+func (q *Query) context(m M) context.Context {
+	conn := q.Connection().(*Connection)
+	if ctx, ok := m.Get(KeyContext, nil).(context.Context); ok && ctx != nil {
+		return conn.sessionContext(ctx)
+	}
+	return conn.Context()
+}
+
+// setting returns the value of key given in m, or from the query config if m
+// does not have it
+func (q *Query) setting(m M, key string) interface{} {
+	if v, ok := m[key]; ok {
+		return v
+	}
+	return q.Config(key, nil)
+}
+
+// collection returns the collection handle of tablename with the read
+// preference, read concern and write concern of the query applied. Its
+// database is the KeyDatabase setting or the one in tablename, see
+// Connection.Table. A mongomem connection returns its in memory collection.
+// The client of the collection is kept until done is called.
+func (q *Query) collection(conn *Connection, tablename string, m M) (coll collection, done func(), err error) {
+	database, _ := q.setting(m, KeyDatabase).(string)
+	if conn.mem != nil {
+		database, tablename = conn.splitTable(tablename, database)
+		if database == "" {
+			return nil, nil, toolkit.Errorf("no database selected for %s", tablename)
+		}
+		return conn.mem.collection(database, tablename), func() {}, nil
+	}
+
+	if conn.shared != nil && conn.shared.policy.reconnect {
+		//-- rebuild the client first if the deployment was lost
+		conn.shared.state(q.context(m))
+	}
+
+	client, done := conn.useClient()
+	db, name, err := conn.table(client, tablename, database)
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+
+	opts, err := collectionOptions(func(key string) interface{} {
+		return q.setting(m, key)
+	}, db)
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	mcoll := mongoCollection{Collection: db.Collection(name, opts)}
+	if !conn.InTransaction() {
+		//-- a transaction reads from the primary
+		mcoll.readPref = opts.ReadPreference
+		if mcoll.readPref == nil {
+			mcoll.readPref = db.ReadPreference()
+		}
+	}
+	return mcoll, done, nil
+}
+
 func (q *Query) Cursor(m M) df.ICursor {
+	ctx := q.context(m)
+	spanCtx, span := q.startSpan(ctx, m, q.cursorOperation(m))
+	cursor := q.cursor(spanCtx, m)
+	//-- fetch spans are children of the caller span, not of this one
+	cursor.ctx = ctx
+	endSpan(span, cursor.Error())
+	if cursor.Error() != nil {
+		cursor.Close()
+	}
+	return cursor
+}
+
+func (q *Query) cursor(ctx context.Context, m M) *Cursor {
 	cursor := new(Cursor)
 	cursor.SetThis(cursor)
 	conn := q.Connection().(*Connection)
+	cursor.conn = conn
+	cursor.ctx = ctx
 
 	tablename := q.Config(df.ConfigKeyTableName, "").(string)
-	coll := conn.db.Collection(tablename)
+	coll, done, err := q.collection(conn, tablename, m)
+	if err != nil {
+		cursor.SetError(err)
+		return cursor
+	}
+	cursor.coll = coll
+	cursor.done = done
+	cursor.tablename = coll.Name()
 
 	parts := q.Config(df.ConfigKeyGroupedQueryItems, df.GroupedQueryItems{}).(df.GroupedQueryItems)
 	where := q.Config(df.ConfigKeyWhere, M{}).(M)
-	hasWhere := where != nil
 
-	aggrs, hasAggr := parts[df.QueryAggr]
-	groupby, hasGroup := parts[df.QueryGroup]
+	_, hasAggr := parts[df.QueryAggr]
 	//commandParts, hasCommand := parts[df.QueryCommand]
 	commandParts, hasCommand := parts[df.QueryCommand]
 
-	if hasAggr {
-		pipes := []M{}
-		items := aggrs[0].Value.([]*df.AggrItem)
-		aggrExpression := M{}
-		for _, item := range items {
-			if item.Op == df.AggrCount {
-				aggrExpression.Set(item.Alias, M{}.Set(string(df.AggrSum), 1))
-			} else {
-				aggrExpression.Set(item.Alias, M{}.Set(string(item.Op), "$"+item.Field))
-			}
-		}
-		if !hasGroup {
-			aggrExpression.Set("_id", "")
-		} else {
-			groups := func() M {
-				s := M{}
-				for _, v := range groupby {
-					gs := v.Value.([]string)
-					for _, g := range gs {
-						if strings.TrimSpace(g) != "" {
-							s.Set(strings.Replace(g, ".", "_", -1), "$"+g)
-						}
-					}
-				}
-				return s
-			}()
-			aggrExpression.Set("_id", groups)
+	//-- the query options are of find and aggregate, a command cursor has
+	//-- none and is not failed by them
+	var qo *queryOptions
+	gn := q.setting(m, KeyGeoNear)
+	if hasAggr || gn != nil || !hasCommand {
+		if qo, err = q.queryOptions(m); err != nil {
+			cursor.SetError(err)
+			return cursor
 		}
+	}
 
-		if hasWhere {
-			pipes = append(pipes, M{}.Set("$match", where))
-		}
-		pipes = append(pipes, M{}.Set("$group", aggrExpression))
-		cur, err := coll.Aggregate(conn.ctx, pipes, new(options.AggregateOptions).SetAllowDiskUse(true))
+	if hasAggr {
+		pipes := aggrPipeline(where, parts)
+		aggrOpt := new(options.AggregateOptions).SetAllowDiskUse(true)
+		qo.aggregate(aggrOpt)
+		cur, err := coll.Aggregate(ctx, pipes, aggrOpt)
 		if err != nil {
 			cursor.SetError(err)
 		} else {
 			cursor.cursor = cur
-			cursor.conn = conn
 			cursor.countParm = toolkit.M{}.
-				Set("count", tablename).
+				Set("count", coll.Name()).
 				Set("query", where)
 		}
+	} else if gn != nil {
+		pipes, err := geoNearPipeline(gn, where, parts)
+		if err != nil {
+			cursor.SetError(err)
+			return cursor
+		}
+		aggrOpt := options.Aggregate()
+		qo.aggregate(aggrOpt)
+		cur, err := coll.Aggregate(ctx, pipes, aggrOpt)
+		if err != nil {
+			cursor.SetError(err)
+		} else {
+			cursor.cursor = cur
+		}
 	} else if hasCommand {
 		mCmd := commandParts[0].Value.(toolkit.M)
 		cmdObj, _ := mCmd["command"]
 		switch cmdObj.(type) {
-		case toolkit.M:
+		case toolkit.M, bson.D:
 			//cmdParm := cmdObj.(toolkit.M).Get("commandParm")
-			curCommand, err := conn.db.RunCommandCursor(conn.ctx, cmdObj)
+			cmdDoc, err := commandDoc(cmdObj)
+			if err != nil {
+				cursor.SetError(err)
+				return cursor
+			}
+			curCommand, err := coll.RunCommandCursor(ctx, cmdDoc)
 			if err != nil {
 				cursor.SetError(err)
 			} else {
@@ -196,17 +262,18 @@ func (q *Query) Cursor(m M) df.ICursor {
 		return cursor
 	} else {
 		opt := options.Find()
-		if items, ok := parts[df.QuerySelect]; ok {
-			fields := items[0].Value.([]string)
-			if len(fields) > 0 {
-				opt.SetProjection(fields)
-			}
+		projection, sort, err := q.findDocs(m, parts)
+		if err != nil {
+			cursor.SetError(err)
+			return cursor
 		}
-
-		if items, ok := parts[df.QueryOrder]; ok {
-			sortKeys := items[0].Value.([]string)
-			opt.SetSort(sortKeys)
+		if len(projection) > 0 {
+			opt.SetProjection(projection)
+		}
+		if len(sort) > 0 {
+			opt.SetSort(sort)
 		}
+		qo.find(opt)
 
 		if items, ok := parts[df.QuerySkip]; ok {
 			skip := items[0].Value.(int64)
@@ -218,30 +285,40 @@ func (q *Query) Cursor(m M) df.ICursor {
 			opt.SetLimit(take)
 		}
 
-		var (
-			qry *mongo.Cursor
-			err error
-		)
-
-		qry, err = coll.Find(conn.ctx, where, opt)
-		//toolkit.Logger().Debugf("querying data. where:%v error:%v", where, err)
-
+		var qry *mongo.Cursor
+		qry, err = coll.Find(ctx, where, opt)
 		if err != nil {
 			cursor.SetError(err)
 			return cursor
 		}
 
 		cursor.cursor = qry
-		cursor.countParm = toolkit.M{}.Set("count", tablename).Set("query", where)
-		cursor.conn = conn
+		cursor.countParm = toolkit.M{}.Set("count", coll.Name()).Set("query", where)
 	}
 	return cursor
 }
 
 func (q *Query) Execute(m M) (interface{}, error) {
+	ctx, span := q.startSpan(q.context(m), m, q.executeOperation())
+	res, err := q.execute(ctx, m)
+	endSpan(span, err)
+	return res, err
+}
+
+func (q *Query) execute(ctx context.Context, m M) (interface{}, error) {
 	tablename := q.Config(df.ConfigKeyTableName, "").(string)
 	conn := q.Connection().(*Connection)
-	coll := conn.db.Collection(tablename)
+	coll, done, err := q.collection(conn, tablename, m)
+	if err != nil {
+		return nil, err
+	}
+	//-- a watch keeps the client until its change stream is closed
+	watching := false
+	defer func() {
+		if !watching {
+			done()
+		}
+	}()
 	data := m.Get("data")
 
 	parts := q.Config(df.ConfigKeyGroupedQueryItems, df.GroupedQueryItems{}).(df.GroupedQueryItems)
@@ -251,7 +328,7 @@ func (q *Query) Execute(m M) (interface{}, error) {
 	ct := q.Config(df.ConfigKeyCommandType, "N/A")
 	switch ct {
 	case df.QueryInsert:
-		return coll.InsertOne(conn.ctx, data)
+		return coll.InsertOne(ctx, data)
 
 	case df.QueryUpdate:
 		var err error
@@ -259,36 +336,15 @@ func (q *Query) Execute(m M) (interface{}, error) {
 			//singleupdate := m.Get("singleupdate", true).(bool)
 			singleupdate := false
 			if !singleupdate {
-				//-- get the field for update
-				updateqi, _ := parts[df.QueryUpdate]
-				updatevals := updateqi[0].Value.([]string)
-
-				var dataM toolkit.M
-				dataM, err = ToM(data)
-				dataS := M{}
-				if err != nil {
+				var dataS M
+				if dataS, err = updateData(data, parts); err != nil {
 					return nil, err
 				}
 
-				if len(updatevals) > 0 {
-					for k, v := range dataM {
-						for _, u := range updatevals {
-							if strings.ToLower(k) == strings.ToLower(u) {
-								dataS[k] = v
-							}
-						}
-					}
-				} else {
-					for k, v := range dataM {
-						dataS[k] = v
-					}
-				}
-				//updatedData := toolkit.M{}.Set("$set", dataS)
-
-				_, err = coll.UpdateMany(conn.ctx, where, dataS,
+				_, err = coll.UpdateMany(ctx, where, dataS,
 					new(options.UpdateOptions).SetUpsert(true))
 			} else {
-				_, err = coll.UpdateOne(conn.ctx, where, data,
+				_, err = coll.UpdateOne(ctx, where, data,
 					new(options.UpdateOptions).SetUpsert(true))
 			}
 			return nil, err
@@ -298,25 +354,19 @@ func (q *Query) Execute(m M) (interface{}, error) {
 
 	case df.QueryDelete:
 		if hasWhere {
-			_, err := coll.DeleteMany(conn.ctx, where)
+			_, err := coll.DeleteMany(ctx, where)
 			return nil, err
 		} else {
 			return nil, toolkit.Errorf("delete need to have where clause. For delete all data in a collection, please use DropTable instead of Delete")
 		}
 
 	case df.QuerySave:
-		whereSave := M{}
-		datam, err := toolkit.ToM(data)
+		whereSave, datam, err := saveData(data)
 		if err != nil {
-			return nil, toolkit.Errorf("unable to deserialize data: %s", err.Error())
-		}
-		if datam.Has("_id") {
-			whereSave = M{}.Set("_id", datam.Get("_id"))
-		} else {
-			return nil, toolkit.Error("_id field is required")
+			return nil, err
 		}
 
-		_, err = coll.UpdateMany(conn.ctx, whereSave,
+		_, err = coll.UpdateMany(ctx, whereSave,
 			toolkit.M{}.Set("$set", datam),
 			new(options.UpdateOptions).SetUpsert(true))
 		return nil, err
@@ -338,19 +388,20 @@ func (q *Query) Execute(m M) (interface{}, error) {
 			}
 
 			var (
-				bucket      *gridfs.Bucket
+				bucket      fileBucket
 				gfsBuffSize int32
 				err         error
 			)
 			if strings.ToLower(commandTxt)[:3] == "gfs" {
 				gfsBuffSize = int32(m.Get("size", 1024).(int))
-				bucketOpt := new(options.BucketOptions)
-				bucketOpt.SetChunkSizeBytes(gfsBuffSize)
-				bucketOpt.SetName(tablename)
-				bucket, err = gridfs.NewBucket(conn.db, bucketOpt)
+				bucket, err = coll.Bucket(gfsBuffSize)
 				if err != nil {
 					return nil, toolkit.Errorf("error prepare GridFS bucket. %s", err.Error())
 				}
+				if deadline, ok := ctx.Deadline(); ok {
+					bucket.SetReadDeadline(deadline)
+					bucket.SetWriteDeadline(deadline)
+				}
 			}
 
 			switch strings.ToLower(commandTxt) {
@@ -359,14 +410,15 @@ func (q *Query) Execute(m M) (interface{}, error) {
 				gfsId, hasId := m["id"]
 				gfsMetadata, hasMetadata := m["metadata"]
 				gfsFileName := m.GetString("name")
-				reader = m.Get("source", nil).(io.Reader)
+				reader, _ = m.Get("source", nil).(io.Reader)
 				if reader == nil {
 					return nil, toolkit.Errorf("invalid reader")
 				}
+				reader = &ctxReader{ctx, reader}
 
 				//-- check if file exist, delete if already exist
 				if hasId {
-					bucket.Delete(gfsId)
+					bucket.DeleteContext(ctx, gfsId)
 				}
 
 				if !hasMetadata {
@@ -401,20 +453,21 @@ func (q *Query) Execute(m M) (interface{}, error) {
 				dest := m.Get("output", &bufio.Writer{}).(io.Writer)
 				var err error
 
-				var ds *gridfs.DownloadStream
+				var ds io.ReadCloser
 				if hasId {
 					ds, err = bucket.OpenDownloadStream(gfsId)
 				} else {
 					ds, err = bucket.OpenDownloadStreamByName(gfsFileName)
 				}
-				defer ds.Close()
 
 				if err != nil {
 					return nil, toolkit.Errorf("unable to open GFS %s-%s. %s", tablename, gfsFileName, err.Error())
 				}
 				defer ds.Close()
 
-				io.Copy(dest, ds)
+				if _, err = io.Copy(&ctxWriter{ctx, dest}, ds); err != nil {
+					return nil, toolkit.Errorf("unable to read GFS %s-%s. %s", tablename, gfsFileName, err.Error())
+				}
 				return nil, nil
 
 			case "gfsremove", "gfsdelete":
@@ -422,12 +475,12 @@ func (q *Query) Execute(m M) (interface{}, error) {
 
 				var err error
 				if hasId && gfsId != "" {
-					err = bucket.Delete(gfsId)
+					err = bucket.DeleteContext(ctx, gfsId)
 				}
 				return nil, err
 
 			case "gfstruncate":
-				err := bucket.Drop()
+				err := bucket.DropContext(ctx)
 				return nil, err
 
 			case "watch":
@@ -441,16 +494,18 @@ func (q *Query) Execute(m M) (interface{}, error) {
 				opt.SetMaxAwaitTime(24 * time.Hour)
 
 				toolkit.Logger().Debugf("prepare to wacth %s", tablename)
-				cs, err := coll.Watch(conn.ctx, []toolkit.M{}, opt)
+				cs, err := coll.Watch(ctx, []toolkit.M{}, opt)
 				if err != nil {
 					toolkit.Logger().Debugf("watch %s has error", tablename, err.Error())
 					return nil, err
 				}
 				toolkit.Logger().Debugf("watch %s is currently running", tablename)
 
+				watching = true
 				go func() {
-					defer cs.Close(conn.ctx)
-					for cs.Next(conn.ctx) {
+					defer done()
+					defer cs.Close(ctx)
+					for cs.Next(ctx) {
 						data := toolkit.M{}
 						if err = cs.Decode(&data); err != nil {
 							continue
@@ -463,12 +518,15 @@ func (q *Query) Execute(m M) (interface{}, error) {
 				return nil, toolkit.Errorf("Invalid command: %v", commandTxt)
 			}
 
-		case toolkit.M:
-			cmdM := cmd.(toolkit.M)
-			sr := conn.db.RunCommand(conn.ctx, cmdM)
+		case toolkit.M, bson.D:
+			cmdDoc, err := commandDoc(cmd)
+			if err != nil {
+				return nil, err
+			}
+			sr := coll.RunCommand(ctx, cmdDoc)
 			if sr.Err() != nil {
-				return nil, toolkit.Errorf("unablet to run command. %s. Command: %s",
-					sr.Err().Error(), toolkit.JsonString(cmdM))
+				return nil, wrapError(sr.Err(), "unablet to run command. %s. Command: %s",
+					sr.Err().Error(), toolkit.JsonString(cmd))
 			}
 			return sr, nil
 
@@ -0,0 +1,338 @@
+package flexmgo
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eaciit/toolkit"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Keys of the options of a find, set per query through the query config or
+// the toolkit.M given to Cursor. An aggregate uses the hint, the max time,
+// the collation, the batch size and the comment, the server does not support
+// the others there.
+//
+// A hint is an index name or its keys, as a bson.D or as order by keys like
+// []string{"-age", "name"}. A collation is a locale like "fr", an
+// options.Collation or a toolkit.M of its fields like
+// toolkit.M{"locale": "en", "strength": 2}. The min and max bounds of an
+// index are a bson.D, or a toolkit.M of one field, and need a hint.
+const (
+	KeyHint                = "hint"
+	KeyMaxTime             = "maxTimeMS"
+	KeyCollation           = "collation"
+	KeyBatchSize           = "batchSize"
+	KeyNoCursorTimeout     = "noCursorTimeout"
+	KeyAllowPartialResults = "allowPartialResults"
+	KeyComment             = "comment"
+	KeyMin                 = "min"
+	KeyMax                 = "max"
+	KeyReturnKey           = "returnKey"
+)
+
+// queryOptions are the options of a find or an aggregate, nil when they are
+// not set
+type queryOptions struct {
+	hint                interface{}
+	maxTime             *time.Duration
+	collation           *options.Collation
+	batchSize           *int32
+	noCursorTimeout     *bool
+	allowPartialResults *bool
+	comment             *string
+	min, max            interface{}
+	returnKey           *bool
+}
+
+// queryOptions reads the options of the query from m or its config
+func (q *Query) queryOptions(m toolkit.M) (*queryOptions, error) {
+	return queryOptionsOf(func(key string) interface{} {
+		return q.setting(m, key)
+	})
+}
+
+// optionGetter returns the value of a query option key, nil when it is not
+// set
+type optionGetter func(key string) interface{}
+
+// queryOptionsOf reads the options of a query from get
+func queryOptionsOf(get optionGetter) (*queryOptions, error) {
+	o := new(queryOptions)
+	var err error
+	if v := get(KeyHint); v != nil {
+		if o.hint, err = hintValue(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := get(KeyMaxTime); v != nil {
+		d, err := configDuration(v, time.Millisecond)
+		if err != nil {
+			return nil, toolkit.Errorf("invalid %s. %s", KeyMaxTime, err.Error())
+		}
+		o.maxTime = &d
+	}
+	if v := get(KeyCollation); v != nil {
+		if o.collation, err = collationValue(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := get(KeyBatchSize); v != nil {
+		n, err := configInt(v)
+		if err != nil || n <= 0 || n > 1<<31-1 {
+			return nil, toolkit.Errorf("invalid %s %v", KeyBatchSize, v)
+		}
+		size := int32(n)
+		o.batchSize = &size
+	}
+	for key, dest := range map[string]**bool{
+		KeyNoCursorTimeout:     &o.noCursorTimeout,
+		KeyAllowPartialResults: &o.allowPartialResults,
+		KeyReturnKey:           &o.returnKey,
+	} {
+		if v := get(key); v != nil {
+			b, err := configBool(v)
+			if err != nil {
+				return nil, toolkit.Errorf("invalid %s. %s", key, err.Error())
+			}
+			*dest = &b
+		}
+	}
+	if v := get(KeyComment); v != nil {
+		comment := fmt.Sprintf("%v", v)
+		o.comment = &comment
+	}
+	if v := get(KeyMin); v != nil {
+		if o.min, err = boundValue(KeyMin, v); err != nil {
+			return nil, err
+		}
+	}
+	if v := get(KeyMax); v != nil {
+		if o.max, err = boundValue(KeyMax, v); err != nil {
+			return nil, err
+		}
+	}
+	if (o.min != nil || o.max != nil) && o.hint == nil {
+		return nil, toolkit.Errorf("%s and %s need a %s", KeyMin, KeyMax, KeyHint)
+	}
+	return o, nil
+}
+
+// hintValue is the index name or the index keys of a hint
+func hintValue(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case string:
+		if strings.TrimSpace(x) == "" {
+			return nil, toolkit.Errorf("invalid %s, it needs an index", KeyHint)
+		}
+		return x, nil
+	case []string:
+		if len(x) == 0 {
+			return nil, toolkit.Errorf("invalid %s, it needs an index", KeyHint)
+		}
+		keys, err := sortDoc(x)
+		if err != nil {
+			return nil, toolkit.Errorf("invalid %s. %s", KeyHint, err.Error())
+		}
+		return keys, nil
+	case bson.D:
+		if len(x) == 0 {
+			return nil, toolkit.Errorf("invalid %s, it needs an index", KeyHint)
+		}
+		return x, nil
+	}
+	return nil, toolkit.Errorf("invalid %s %T, it should be an index name or its keys", KeyHint, v)
+}
+
+// boundValue is the min or max bound v as a document whose fields keep their
+// order
+func boundValue(key string, v interface{}) (bson.D, error) {
+	var m map[string]interface{}
+	switch x := v.(type) {
+	case bson.D:
+		if len(x) > 0 {
+			return x, nil
+		}
+	case toolkit.M:
+		m = x
+	case bson.M:
+		m = x
+	case map[string]interface{}:
+		m = x
+	default:
+		return nil, toolkit.Errorf("invalid %s %T, it should be a bson.D", key, v)
+	}
+	if len(m) != 1 {
+		return nil, toolkit.Errorf("invalid %s, it should be a bson.D of the index fields", key)
+	}
+	for k, value := range m {
+		return bson.D{{Key: k, Value: value}}, nil
+	}
+	return nil, nil
+}
+
+// collationValue reads a collation given as a locale, an options.Collation
+// or a toolkit.M of its fields
+func collationValue(v interface{}) (*options.Collation, error) {
+	c := new(options.Collation)
+	switch x := v.(type) {
+	case string:
+		c.Locale = strings.TrimSpace(x)
+	case options.Collation:
+		*c = x
+	case *options.Collation:
+		if x != nil {
+			*c = *x
+		}
+	case map[string]interface{}:
+		return collationValue(toolkit.M(x))
+	case toolkit.M:
+		for k, value := range x {
+			var err error
+			switch k {
+			case "locale":
+				c.Locale = fmt.Sprintf("%v", value)
+			case "strength":
+				var n int64
+				n, err = configInt(value)
+				c.Strength = int(n)
+			case "caseLevel":
+				c.CaseLevel, err = configBool(value)
+			case "caseFirst":
+				c.CaseFirst = fmt.Sprintf("%v", value)
+			case "numericOrdering":
+				c.NumericOrdering, err = configBool(value)
+			case "alternate":
+				c.Alternate = fmt.Sprintf("%v", value)
+			case "maxVariable":
+				c.MaxVariable = fmt.Sprintf("%v", value)
+			case "normalization":
+				c.Normalization, err = configBool(value)
+			case "backwards":
+				c.Backwards, err = configBool(value)
+			default:
+				return nil, toolkit.Errorf("invalid %s field %s", KeyCollation, k)
+			}
+			if err != nil {
+				return nil, toolkit.Errorf("invalid %s %s. %s", KeyCollation, k, err.Error())
+			}
+		}
+	default:
+		return nil, toolkit.Errorf("invalid %s %T", KeyCollation, v)
+	}
+
+	if c.Locale == "" {
+		return nil, toolkit.Errorf("invalid %s, it needs a locale", KeyCollation)
+	}
+	if c.Strength < 0 || c.Strength > 5 {
+		return nil, toolkit.Errorf("invalid %s strength %d, it should be 1 to 5", KeyCollation, c.Strength)
+	}
+	return c, nil
+}
+
+// find sets the options on a find
+func (o *queryOptions) find(opt *options.FindOptions) {
+	if o.hint != nil {
+		opt.SetHint(o.hint)
+	}
+	if o.maxTime != nil {
+		opt.SetMaxTime(*o.maxTime)
+	}
+	if o.collation != nil {
+		opt.SetCollation(o.collation)
+	}
+	if o.batchSize != nil {
+		opt.SetBatchSize(*o.batchSize)
+	}
+	if o.noCursorTimeout != nil {
+		opt.SetNoCursorTimeout(*o.noCursorTimeout)
+	}
+	if o.allowPartialResults != nil {
+		opt.SetAllowPartialResults(*o.allowPartialResults)
+	}
+	if o.comment != nil {
+		opt.SetComment(*o.comment)
+	}
+	if o.min != nil {
+		opt.SetMin(o.min)
+	}
+	if o.max != nil {
+		opt.SetMax(o.max)
+	}
+	if o.returnKey != nil {
+		opt.SetReturnKey(*o.returnKey)
+	}
+}
+
+// aggregate sets the options an aggregate supports
+func (o *queryOptions) aggregate(opt *options.AggregateOptions) {
+	if o.hint != nil {
+		opt.SetHint(o.hint)
+	}
+	if o.maxTime != nil {
+		opt.SetMaxTime(*o.maxTime)
+	}
+	if o.collation != nil {
+		opt.SetCollation(o.collation)
+	}
+	if o.batchSize != nil {
+		opt.SetBatchSize(*o.batchSize)
+	}
+	if o.comment != nil {
+		opt.SetComment(*o.comment)
+	}
+}
+
+// findCommand adds the options to the find command cmd
+func (o *queryOptions) findCommand(cmd bson.D) bson.D {
+	cmd = o.sharedCommand(cmd)
+	if o.batchSize != nil {
+		cmd = append(cmd, bson.E{Key: "batchSize", Value: *o.batchSize})
+	}
+	if o.noCursorTimeout != nil {
+		cmd = append(cmd, bson.E{Key: "noCursorTimeout", Value: *o.noCursorTimeout})
+	}
+	if o.allowPartialResults != nil {
+		cmd = append(cmd, bson.E{Key: "allowPartialResults", Value: *o.allowPartialResults})
+	}
+	if o.min != nil {
+		cmd = append(cmd, bson.E{Key: "min", Value: o.min})
+	}
+	if o.max != nil {
+		cmd = append(cmd, bson.E{Key: "max", Value: o.max})
+	}
+	if o.returnKey != nil {
+		cmd = append(cmd, bson.E{Key: "returnKey", Value: *o.returnKey})
+	}
+	return cmd
+}
+
+// aggregateCommand adds the options to the aggregate command cmd, whose
+// last field is its cursor
+func (o *queryOptions) aggregateCommand(cmd bson.D) bson.D {
+	cursor := cmd[len(cmd)-1]
+	cmd = o.sharedCommand(cmd[:len(cmd)-1])
+	if o.batchSize != nil {
+		cursor.Value = bson.D{{Key: "batchSize", Value: *o.batchSize}}
+	}
+	return append(cmd, cursor)
+}
+
+// sharedCommand adds the options of both a find and an aggregate to cmd
+func (o *queryOptions) sharedCommand(cmd bson.D) bson.D {
+	if o.hint != nil {
+		cmd = append(cmd, bson.E{Key: "hint", Value: o.hint})
+	}
+	if o.maxTime != nil {
+		cmd = append(cmd, bson.E{Key: "maxTimeMS", Value: int64(*o.maxTime / time.Millisecond)})
+	}
+	if o.collation != nil {
+		cmd = append(cmd, bson.E{Key: "collation", Value: o.collation.ToDocument()})
+	}
+	if o.comment != nil {
+		cmd = append(cmd, bson.E{Key: "comment", Value: *o.comment})
+	}
+	return cmd
+}
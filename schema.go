@@ -0,0 +1,403 @@
+package flexmgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eaciit/toolkit"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	validationLevels  = map[string]bool{"off": true, "strict": true, "moderate": true}
+	validationActions = map[string]bool{"error": true, "warn": true}
+
+	timeType       = reflect.TypeOf(time.Time{})
+	objectIDType   = reflect.TypeOf(primitive.ObjectID{})
+	decimalType    = reflect.TypeOf(primitive.Decimal128{})
+	dateTimeType   = reflect.TypeOf(primitive.DateTime(0))
+	bytesType      = reflect.TypeOf([]byte{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// tableNamer is implemented by orm.DataModel
+type tableNamer interface {
+	TableName() string
+}
+
+// SchemaDriftError is returned by ValidateTable when the validator of an
+// existing collection does not match the model and autoUpdate is false
+type SchemaDriftError struct {
+	Table  string
+	Drifts []string
+}
+
+func (e *SchemaDriftError) Error() string {
+	return fmt.Sprintf("validator of %s differs from model: %s", e.Table, strings.Join(e.Drifts, "; "))
+}
+
+// ValidateTable makes sure the collection of obj exists with a $jsonSchema
+// validator generated from obj by JSONSchema. A missing collection is
+// created. For an existing one the live validator is compared to the model:
+// with autoUpdate it is replaced using collMod, otherwise the differences
+// are returned as a *SchemaDriftError. Validation level and action are read
+// from the validationLevel and validationAction config, default strict and
+// error.
+func (c *Connection) ValidateTable(obj interface{}, autoUpdate bool) error {
+	tn, ok := obj.(tableNamer)
+	if !ok {
+		return toolkit.Errorf("unable to get table name of %T, it should implement TableName()", obj)
+	}
+	tablename := tn.TableName()
+
+	level, action, err := c.validationSettings()
+	if err != nil {
+		return err
+	}
+
+	schema, err := JSONSchema(obj)
+	if err != nil {
+		return err
+	}
+
+	db, name, err := c.Table(tablename, "")
+	if err != nil {
+		return err
+	}
+	ctx := c.Context()
+
+	cur, err := db.ListCollections(ctx, bson.M{"name": name})
+	if err != nil {
+		return toolkit.Errorf("unable to read collection %s. %s", tablename, err.Error())
+	}
+	defer cur.Close(ctx)
+
+	if !cur.Next(ctx) {
+		if err = cur.Err(); err != nil {
+			return toolkit.Errorf("unable to read collection %s. %s", tablename, err.Error())
+		}
+
+		opts := options.CreateCollection().
+			SetValidator(bson.M{"$jsonSchema": schema}).
+			SetValidationLevel(level).
+			SetValidationAction(action)
+		if err = db.CreateCollection(ctx, name, opts); err != nil {
+			return toolkit.Errorf("unable to create collection %s. %s", tablename, err.Error())
+		}
+		return nil
+	}
+
+	info := struct {
+		Options struct {
+			Validator        bson.M `bson:"validator"`
+			ValidationLevel  string `bson:"validationLevel"`
+			ValidationAction string `bson:"validationAction"`
+		} `bson:"options"`
+	}{}
+	if err = cur.Decode(&info); err != nil {
+		return toolkit.Errorf("unable to decode collection info of %s. %s", tablename, err.Error())
+	}
+
+	drifts := schemaDrift("", schema, normalizeDoc(info.Options.Validator["$jsonSchema"]))
+	if live := info.Options.ValidationLevel; live != "" && live != level {
+		drifts = append(drifts, fmt.Sprintf("validationLevel is %s, expected %s", live, level))
+	}
+	if live := info.Options.ValidationAction; live != "" && live != action {
+		drifts = append(drifts, fmt.Sprintf("validationAction is %s, expected %s", live, action))
+	}
+	if len(drifts) == 0 {
+		return nil
+	}
+
+	if !autoUpdate {
+		return &SchemaDriftError{Table: tablename, Drifts: drifts}
+	}
+
+	sr := db.RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: name},
+		{Key: "validator", Value: bson.M{"$jsonSchema": schema}},
+		{Key: "validationLevel", Value: level},
+		{Key: "validationAction", Value: action},
+	})
+	if err = sr.Err(); err != nil {
+		return toolkit.Errorf("unable to update validator of %s. %s", tablename, err.Error())
+	}
+	return nil
+}
+
+func (c *Connection) validationSettings() (string, string, error) {
+	level := strings.ToLower(c.configString("validationLevel"))
+	if level == "" {
+		level = "strict"
+	} else if !validationLevels[level] {
+		return "", "", toolkit.Errorf("invalid validationLevel %s", level)
+	}
+
+	action := strings.ToLower(c.configString("validationAction"))
+	if action == "" {
+		action = "error"
+	} else if !validationActions[action] {
+		return "", "", toolkit.Errorf("invalid validationAction %s", action)
+	}
+	return level, action, nil
+}
+
+// JSONSchema returns the $jsonSchema document of a struct. Field names follow
+// the bson tag, or the lower cased field name like the driver does. A field
+// tagged required:"true" is required. Pointer, slice and map fields also
+// accept null, which the driver writes for a nil one. Nested structs become
+// objects and slices become arrays of their element schema.
+func JSONSchema(obj interface{}) (toolkit.M, error) {
+	t := reflect.TypeOf(obj)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, toolkit.Errorf("unable to build schema of %T, it should be a struct", obj)
+	}
+	return typeSchema(t, map[reflect.Type]bool{}), nil
+}
+
+func typeSchema(t reflect.Type, visiting map[reflect.Type]bool) toolkit.M {
+	nullable := false
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		nullable = true
+	}
+
+	var schema toolkit.M
+	switch {
+	case t == timeType || t == dateTimeType:
+		schema = toolkit.M{"bsonType": "date"}
+	case t == objectIDType:
+		schema = toolkit.M{"bsonType": "objectId"}
+	case t == decimalType:
+		schema = toolkit.M{"bsonType": "decimal"}
+	case t == bytesType || t == rawMessageType:
+		schema = toolkit.M{"bsonType": "binData"}
+		nullable = true
+	default:
+		switch t.Kind() {
+		case reflect.String:
+			schema = toolkit.M{"bsonType": "string"}
+		case reflect.Bool:
+			schema = toolkit.M{"bsonType": "bool"}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			schema = toolkit.M{"bsonType": []interface{}{"int", "long"}}
+		case reflect.Float32, reflect.Float64:
+			schema = toolkit.M{"bsonType": []interface{}{"double", "int", "long", "decimal"}}
+		case reflect.Slice, reflect.Array:
+			schema = toolkit.M{"bsonType": "array"}
+			if items := typeSchema(t.Elem(), visiting); len(items) > 0 {
+				schema.Set("items", items)
+			}
+			nullable = nullable || t.Kind() == reflect.Slice
+		case reflect.Map:
+			schema = toolkit.M{"bsonType": "object"}
+			nullable = true
+		case reflect.Struct:
+			if visiting[t] {
+				//-- recursive type, stop describing it here
+				schema = toolkit.M{"bsonType": "object"}
+				break
+			}
+			visiting[t] = true
+			schema = structSchema(t, visiting)
+			delete(visiting, t)
+		default:
+			//-- interface and anything else is not constrained
+			return toolkit.M{}
+		}
+	}
+
+	if nullable {
+		switch bt := schema["bsonType"].(type) {
+		case string:
+			schema["bsonType"] = []interface{}{bt, "null"}
+		case []interface{}:
+			schema["bsonType"] = append(bt, "null")
+		}
+	}
+	return schema
+}
+
+func structSchema(t reflect.Type, visiting map[reflect.Type]bool) toolkit.M {
+	properties := toolkit.M{}
+	required := []interface{}{}
+	addFields(t, visiting, properties, &required)
+
+	schema := toolkit.M{"bsonType": "object"}
+	if len(properties) > 0 {
+		schema.Set("properties", properties)
+	}
+	if len(required) > 0 {
+		schema.Set("required", required)
+	}
+	return schema
+}
+
+func addFields(t reflect.Type, visiting map[reflect.Type]bool, properties toolkit.M, required *[]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+
+		name, inline, skip := bsonFieldName(f)
+		if skip {
+			continue
+		}
+
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if inline && ft.Kind() == reflect.Struct {
+			addFields(ft, visiting, properties, required)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+
+		properties.Set(name, typeSchema(f.Type, visiting))
+		if f.Tag.Get("required") == "true" {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// bsonFieldName returns the field name used by the driver
+func bsonFieldName(f reflect.StructField) (name string, inline bool, skip bool) {
+	tag := f.Tag.Get("bson")
+	if tag == "-" {
+		return "", false, true
+	}
+
+	parts := strings.Split(tag, ",")
+	for _, p := range parts[1:] {
+		if p == "inline" {
+			inline = true
+		}
+	}
+	if parts[0] != "" {
+		return parts[0], inline, false
+	}
+	return strings.ToLower(f.Name), inline, false
+}
+
+// normalizeDoc turns a decoded bson value into plain maps and slices
+func normalizeDoc(v interface{}) interface{} {
+	switch x := v.(type) {
+	case primitive.D:
+		m := map[string]interface{}{}
+		for _, e := range x {
+			m[e.Key] = normalizeDoc(e.Value)
+		}
+		return m
+	case primitive.M:
+		m := map[string]interface{}{}
+		for k, e := range x {
+			m[k] = normalizeDoc(e)
+		}
+		return m
+	case toolkit.M:
+		return normalizeDoc(primitive.M(x))
+	case map[string]interface{}:
+		return normalizeDoc(primitive.M(x))
+	case primitive.A:
+		return normalizeDoc([]interface{}(x))
+	case []interface{}:
+		a := make([]interface{}, len(x))
+		for i, e := range x {
+			a[i] = normalizeDoc(e)
+		}
+		return a
+	}
+	return v
+}
+
+// schemaDrift lists the differences between the schema of the model and the
+// live one, walking properties recursively
+func schemaDrift(path string, model toolkit.M, live interface{}) []string {
+	where := "document"
+	if path != "" {
+		where = path
+	}
+
+	liveM, ok := live.(map[string]interface{})
+	if !ok {
+		return []string{fmt.Sprintf("%s has no validator", where)}
+	}
+	modelM := normalizeDoc(model).(map[string]interface{})
+
+	drifts := []string{}
+	if !sameValue(modelM["bsonType"], liveM["bsonType"]) {
+		drifts = append(drifts, fmt.Sprintf("%s type is %v, expected %v", where, jsonText(liveM["bsonType"]), jsonText(modelM["bsonType"])))
+	}
+	if !sameValue(modelM["required"], liveM["required"]) {
+		drifts = append(drifts, fmt.Sprintf("%s required fields are %v, expected %v", where, jsonText(liveM["required"]), jsonText(modelM["required"])))
+	}
+
+	modelItems, _ := model["items"].(toolkit.M)
+	if modelItems != nil || liveM["items"] != nil {
+		if modelItems == nil {
+			modelItems = toolkit.M{}
+		}
+		drifts = append(drifts, schemaDrift(joinPath(path, "[]"), modelItems, liveM["items"])...)
+	}
+
+	modelProps, _ := model["properties"].(toolkit.M)
+	liveProps, _ := liveM["properties"].(map[string]interface{})
+	names := []string{}
+	for name := range modelProps {
+		names = append(names, name)
+	}
+	for name := range liveProps {
+		if _, ok := modelProps[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fieldPath := joinPath(path, name)
+		modelProp, inModel := modelProps[name].(toolkit.M)
+		liveProp, inLive := liveProps[name]
+		switch {
+		case !inLive:
+			drifts = append(drifts, fmt.Sprintf("%s is missing in validator", fieldPath))
+		case !inModel:
+			drifts = append(drifts, fmt.Sprintf("%s is in validator but not in model", fieldPath))
+		default:
+			drifts = append(drifts, schemaDrift(fieldPath, modelProp, liveProp)...)
+		}
+	}
+	return drifts
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	if name == "[]" {
+		return path + name
+	}
+	return path + "." + name
+}
+
+func sameValue(a, b interface{}) bool {
+	return jsonText(a) == jsonText(b)
+}
+
+func jsonText(v interface{}) string {
+	bs, _ := json.Marshal(normalizeDoc(v))
+	return string(bs)
+}
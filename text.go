@@ -0,0 +1,81 @@
+package flexmgo
+
+import (
+	"strings"
+
+	df "git.eaciitapp.com/sebar/dbflex"
+	"github.com/eaciit/toolkit"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// OpText searches the text index of a collection
+const OpText df.FilterOp = "$text"
+
+// KeyTextScore is the cursor parameter, or query config, key of the field
+// the relevance of a Text search is written to. When it is set the results
+// come from the most relevant, the order by keys of the command break ties.
+const KeyTextScore = "textScore"
+
+// TextOptions are the options of a TextWith search
+type TextOptions struct {
+	// Language picks the stop words and the stemming, default the language
+	// of the text index
+	Language           string
+	CaseSensitive      bool
+	DiacriticSensitive bool
+}
+
+// textQuery is the value of a text filter
+type textQuery struct {
+	search string
+	TextOptions
+}
+
+// Text matches documents whose text index has one of the words of search.
+// A "quoted phrase" has to be there as a whole and a -word must not be. The
+// collection needs a text index, for example from a text index tag, see
+// ModelIndexes. Unlike Contains it does not scan the whole collection.
+func Text(search string) *df.Filter {
+	return TextWith(search, TextOptions{})
+}
+
+// TextWith is Text with options
+func TextWith(search string, opts TextOptions) *df.Filter {
+	return df.NewFilter("", OpText, textQuery{search, opts}, nil)
+}
+
+func checkText(f *df.Filter) error {
+	tq, ok := f.Value.(textQuery)
+	if !ok {
+		return toolkit.Errorf("%s has an invalid value %T", f.Op, f.Value)
+	}
+	if strings.TrimSpace(tq.search) == "" {
+		return toolkit.Errorf("%s needs something to search", f.Op)
+	}
+	return nil
+}
+
+func textFilter(f *df.Filter) (interface{}, error) {
+	tq := f.Value.(textQuery)
+	cond := toolkit.M{}.Set("$search", tq.search)
+	if tq.Language != "" {
+		cond.Set("$language", tq.Language)
+	}
+	if tq.CaseSensitive {
+		cond.Set("$caseSensitive", true)
+	}
+	if tq.DiacriticSensitive {
+		cond.Set("$diacriticSensitive", true)
+	}
+	return toolkit.M{}.Set("$text", cond), nil
+}
+
+// textScoreProjection adds the text score in field score to projection
+func textScoreProjection(projection bson.D, score string) bson.D {
+	return append(projection, bson.E{Key: score, Value: bson.M{"$meta": "textScore"}})
+}
+
+// textScoreSort sorts by the text score, then by sort
+func textScoreSort(sort bson.D, score string) bson.D {
+	return append(bson.D{{Key: score, Value: bson.M{"$meta": "textScore"}}}, sort...)
+}
@@ -0,0 +1,197 @@
+package flexmgo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"strings"
+
+	"github.com/eaciit/toolkit"
+	"github.com/youmark/pkcs8"
+)
+
+// tlsOptions are the config keys read by tlsConfig, keyed by their lower case
+// name. Values are the canonical key names.
+var tlsOptions = map[string]string{
+	"tls":                           "tls",
+	"ssl":                           "tls",
+	"tlscafile":                     "tlsCAFile",
+	"tlscertfile":                   "tlsCertFile",
+	"tlskeyfile":                    "tlsKeyFile",
+	"tlscertificatekeyfile":         "tlsCertificateKeyFile",
+	"tlskeypassword":                "tlsKeyPassword",
+	"tlscertificatekeyfilepassword": "tlsKeyPassword",
+	"tlsinsecureskipverify":         "tlsInsecureSkipVerify",
+	"tlsinsecure":                   "tlsInsecureSkipVerify",
+	"tlsallowinvalidcertificates":   "tlsInsecureSkipVerify",
+}
+
+// tlsSettings returns the tls options of the connection Config by their
+// canonical name, nil when TLS is not enabled. No file is read.
+func (c *Connection) tlsSettings() (toolkit.M, error) {
+	settings := toolkit.M{}
+	for k, v := range c.Config {
+		if name, ok := tlsOptions[strings.ToLower(k)]; ok {
+			settings.Set(name, v)
+		}
+	}
+	if len(settings) == 0 {
+		return nil, nil
+	}
+
+	enabled := true
+	if settings.Has("tls") {
+		var err error
+		if enabled, err = configBool(settings.Get("tls")); err != nil {
+			return nil, toolkit.Errorf("invalid value for config tls. %s", err.Error())
+		}
+	}
+	if !enabled {
+		if len(settings) > 1 {
+			return nil, toolkit.Errorf("tls options are set but tls is disabled")
+		}
+		return nil, nil
+	}
+	return settings, nil
+}
+
+// tlsConfig builds the tls.Config of the connection from its Config. It
+// returns nil when TLS is not enabled. CA, certificate and key files are read
+// and parsed here so invalid PEM content is reported on Connect.
+func (c *Connection) tlsConfig() (*tls.Config, error) {
+	settings, err := c.tlsSettings()
+	if err != nil || settings == nil {
+		return nil, err
+	}
+
+	cfg := new(tls.Config)
+	if settings.Has("tlsInsecureSkipVerify") {
+		skip, err := configBool(settings.Get("tlsInsecureSkipVerify"))
+		if err != nil {
+			return nil, toolkit.Errorf("invalid value for config tlsInsecureSkipVerify. %s", err.Error())
+		}
+		cfg.InsecureSkipVerify = skip
+	}
+
+	if caFile := settings.GetString("tlsCAFile"); caFile != "" {
+		bs, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, toolkit.Errorf("unable to read tlsCAFile. %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bs) {
+			return nil, toolkit.Errorf("tlsCAFile %s has no valid PEM certificate", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	certFile := settings.GetString("tlsCertFile")
+	keyFile := settings.GetString("tlsKeyFile")
+	if combined := settings.GetString("tlsCertificateKeyFile"); combined != "" {
+		if certFile != "" || keyFile != "" {
+			return nil, toolkit.Errorf("tlsCertificateKeyFile can not be combined with tlsCertFile or tlsKeyFile")
+		}
+		certFile, keyFile = combined, combined
+	}
+	if certFile == "" && keyFile == "" {
+		if settings.GetString("tlsKeyPassword") != "" {
+			return nil, toolkit.Errorf("tlsKeyPassword is set without a client key")
+		}
+		return cfg, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, toolkit.Errorf("tlsCertFile and tlsKeyFile are both required for a client certificate")
+	}
+
+	cert, err := loadKeyPair(certFile, keyFile, settings.GetString("tlsKeyPassword"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+	return cfg, nil
+}
+
+// loadKeyPair reads the client certificate and its private key. The key may be
+// encrypted, either as legacy PEM encryption or as PKCS#8.
+func loadKeyPair(certFile, keyFile, password string) (tls.Certificate, error) {
+	certBs, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, toolkit.Errorf("unable to read client certificate. %s", err.Error())
+	}
+	keyBs, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, toolkit.Errorf("unable to read client key. %s", err.Error())
+	}
+
+	certPEM := []byte{}
+	var keyPEM []byte
+	for _, bs := range [][]byte{certBs, keyBs} {
+		for {
+			var block *pem.Block
+			block, bs = pem.Decode(bs)
+			if block == nil {
+				break
+			}
+
+			if block.Type == "CERTIFICATE" {
+				certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+				continue
+			}
+			if !strings.HasSuffix(block.Type, "PRIVATE KEY") || keyPEM != nil {
+				continue
+			}
+
+			if keyPEM, err = decryptKey(block, password); err != nil {
+				return tls.Certificate{}, err
+			}
+		}
+		if certFile == keyFile {
+			break
+		}
+	}
+
+	if len(certPEM) == 0 {
+		return tls.Certificate{}, toolkit.Errorf("%s has no valid PEM certificate", certFile)
+	}
+	if keyPEM == nil {
+		return tls.Certificate{}, toolkit.Errorf("%s has no valid PEM private key", keyFile)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, toolkit.Errorf("invalid client certificate or key. %s", err.Error())
+	}
+	return cert, nil
+}
+
+// decryptKey returns the PEM of the private key in block. Only encrypted
+// PKCS#8 keys are decrypted, the legacy PEM encryption is not authenticated
+// and is refused. A password given for a key that is not encrypted is an
+// error rather than being ignored.
+func decryptKey(block *pem.Block, password string) ([]byte, error) {
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		if password == "" {
+			return nil, toolkit.Errorf("client key is encrypted, tlsKeyPassword is required")
+		}
+		key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(password))
+		if err != nil {
+			return nil, toolkit.Errorf("unable to decrypt client key. %s", err.Error())
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, toolkit.Errorf("unable to decrypt client key. %s", err.Error())
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+
+	case strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED"):
+		return nil, toolkit.Errorf("client key uses the legacy PEM encryption which is not supported, " +
+			"convert it to an encrypted PKCS#8 key with openssl pkcs8 -topk8")
+
+	case password != "":
+		return nil, toolkit.Errorf("tlsKeyPassword is set but the client key is not encrypted")
+	}
+
+	return pem.EncodeToMemory(block), nil
+}
@@ -0,0 +1,132 @@
+package flexmgo
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	df "git.eaciitapp.com/sebar/dbflex"
+	"github.com/eaciit/toolkit"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// KeyTracerProvider is the config key of the trace.TracerProvider used for
+// the spans of the connection. Without it the global provider is used, which
+// does nothing until the application sets one with otel.SetTracerProvider.
+const KeyTracerProvider = "tracerProvider"
+
+const instrumentationName = "github.com/eaciit/flexmgo"
+
+func (c *Connection) tracer() trace.Tracer {
+	tp, ok := c.configValue(KeyTracerProvider).(trace.TracerProvider)
+	if !ok || tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(instrumentationName)
+}
+
+// startSpan starts a client span named after operation and collection, as a
+// child of the span in ctx
+func (c *Connection) startSpan(ctx context.Context, operation, database, collection, statement string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system", "mongodb"),
+		attribute.String("db.operation", operation),
+	}
+	if database != "" {
+		attrs = append(attrs, attribute.String("db.name", database))
+	}
+	name := operation
+	if collection != "" {
+		attrs = append(attrs, attribute.String("db.mongodb.collection", collection))
+		name += " " + collection
+	}
+	if statement != "" {
+		attrs = append(attrs, attribute.String("db.statement", statement))
+	}
+	return c.tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+}
+
+// endSpan records err on span, io.EOF is the normal end of a cursor and is
+// not an error
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != io.EOF {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startSpan starts the span of the query. The statement is the where clause,
+// or the command document, with its values redacted.
+func (q *Query) startSpan(ctx context.Context, m toolkit.M, operation string) (context.Context, trace.Span) {
+	conn := q.Connection().(*Connection)
+	database, _ := q.setting(m, KeyDatabase).(string)
+	database, collection := conn.splitTable(q.Config(df.ConfigKeyTableName, "").(string), database)
+
+	statement := ""
+	parts := q.Config(df.ConfigKeyGroupedQueryItems, df.GroupedQueryItems{}).(df.GroupedQueryItems)
+	if _, ok := parts[df.QueryCommand]; ok {
+		if cmd, ok := commandOf(parts).(toolkit.M); ok {
+			statement = redactDocument(cmd)
+		}
+	} else if where, ok := q.Config(df.ConfigKeyWhere, toolkit.M{}).(toolkit.M); ok && len(where) > 0 {
+		statement = redactDocument(where)
+	}
+	return conn.startSpan(ctx, operation, database, collection, statement)
+}
+
+// cursorOperation is the span operation of Cursor
+func (q *Query) cursorOperation(m toolkit.M) string {
+	parts := q.Config(df.ConfigKeyGroupedQueryItems, df.GroupedQueryItems{}).(df.GroupedQueryItems)
+	if _, ok := parts[df.QueryAggr]; ok {
+		return "aggregate"
+	}
+	if q.setting(m, KeyGeoNear) != nil {
+		return "aggregate"
+	}
+	if _, ok := parts[df.QueryCommand]; ok {
+		return "command"
+	}
+	return "find"
+}
+
+// executeOperation is the span operation of Execute, the command name for a
+// string command like gfswrite
+func (q *Query) executeOperation() string {
+	ct, _ := q.Config(df.ConfigKeyCommandType, "N/A").(string)
+	if ct != df.QueryCommand {
+		return strings.ToLower(ct)
+	}
+
+	parts := q.Config(df.ConfigKeyGroupedQueryItems, df.GroupedQueryItems{}).(df.GroupedQueryItems)
+	if name, ok := commandOf(parts).(string); ok && name != "" {
+		return strings.ToLower(name)
+	}
+	return "command"
+}
+
+// commandOf returns the command given to dbflex Command, nil if there is none
+func commandOf(parts df.GroupedQueryItems) interface{} {
+	commands, ok := parts[df.QueryCommand]
+	if !ok || len(commands) == 0 {
+		return nil
+	}
+	mCmd, _ := commands[0].Value.(toolkit.M)
+	return mCmd["command"]
+}
+
+// startSpan starts the span of a cursor call as a child of the span in the
+// context the cursor was created with
+func (cr *Cursor) startSpan(operation string) trace.Span {
+	database := ""
+	if cr.coll != nil {
+		database = cr.coll.Database()
+	}
+	_, span := cr.conn.startSpan(cr.ctx, operation, database, cr.tablename, "")
+	return span
+}
@@ -0,0 +1,200 @@
+package flexmgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"git.eaciitapp.com/sebar/dbflex"
+	"github.com/eaciit/toolkit"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/session"
+)
+
+const (
+	// transactionTimeout bounds the retries of WithTransaction, it is the
+	// same limit the driver uses
+	transactionTimeout = 120 * time.Second
+	// abortTimeout bounds the abort and the end of a session, they do not use
+	// the connection context which may be what ended the transaction
+	abortTimeout = 10 * time.Second
+
+	labelTransientTransaction = "TransientTransactionError"
+	labelUnknownCommitResult  = "UnknownTransactionCommitResult"
+)
+
+// BeginTransaction starts a transaction and returns a connection bound to
+// it. Every query, cursor and call made through the returned connection
+// joins the transaction, including calls given their own context through
+// KeyContext. End it with CommitTransaction or AbortTransaction, closing it
+// aborts a transaction that is still open. The transaction keeps the client
+// open even if c is closed.
+func (c *Connection) BeginTransaction() (*Connection, error) {
+	if c.inMemory {
+		return nil, toolkit.Errorf("transactions are not supported by mongomem")
+	}
+	if c.shared == nil {
+		return nil, toolkit.Errorf("connection is not connected")
+	}
+	if c.session != nil {
+		return nil, toolkit.Errorf("transaction is already started")
+	}
+
+	client, done := c.useClient()
+	sess, err := client.StartSession()
+	if err != nil {
+		done()
+		return nil, toolkit.Errorf("unable to start session. %s", err.Error())
+	}
+	if err = sess.StartTransaction(); err != nil {
+		sess.EndSession(c.Context())
+		done()
+		return nil, toolkit.Errorf("unable to start transaction. %s", err.Error())
+	}
+	if !retainClient(c.sharedKey) {
+		sess.EndSession(c.Context())
+		done()
+		return nil, toolkit.Errorf("connection is closed")
+	}
+
+	tx := new(Connection)
+	tx.ServerInfo = c.ServerInfo
+	tx.SetThis(tx)
+	tx.SetFieldNameTag(c.FieldNameTag())
+	tx.shared = c.shared
+	tx.sharedKey = c.sharedKey
+	tx.session = sess
+	tx.client = client
+	tx.release = done
+	tx.ctx = mongo.NewSessionContext(c.Context(), sess)
+	return tx, nil
+}
+
+// CommitTransaction commits the transaction of c and closes it
+func (c *Connection) CommitTransaction() error {
+	if c.session == nil {
+		return toolkit.Errorf("no transaction is started")
+	}
+	if err := c.session.CommitTransaction(c.Context()); err != nil {
+		return err
+	}
+	c.Close()
+	return nil
+}
+
+// AbortTransaction rolls back the transaction of c and closes it
+func (c *Connection) AbortTransaction() error {
+	if c.session == nil {
+		return toolkit.Errorf("no transaction is started")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	err := c.session.AbortTransaction(ctx)
+	c.Close()
+	return err
+}
+
+// InTransaction returns true if c is bound to an open transaction
+func (c *Connection) InTransaction() bool {
+	return c.session != nil
+}
+
+// WithTransaction runs fn in a transaction and commits it if fn returns no
+// error. fn is run again when the transaction fails with a
+// TransientTransactionError label, and the commit is retried on
+// UnknownTransactionCommitResult, for up to 2 minutes. The errors of
+// Execute and Cursor keep those labels, fn should return them as is or
+// wrapped with %w. fn may be called more than once so it should not have
+// side effects outside the database.
+func (c *Connection) WithTransaction(fn func(tx *Connection) error) error {
+	deadline := time.Now().Add(transactionTimeout)
+	for {
+		tx, err := c.BeginTransaction()
+		if err != nil {
+			return err
+		}
+
+		if err = fn(tx); err != nil {
+			tx.AbortTransaction()
+			if hasErrorLabel(err, labelTransientTransaction) && time.Now().Before(deadline) {
+				continue
+			}
+			return err
+		}
+
+		for {
+			err = tx.session.CommitTransaction(tx.Context())
+			if err == nil || !time.Now().Before(deadline) ||
+				!hasErrorLabel(err, labelUnknownCommitResult) {
+				break
+			}
+		}
+		if err == nil {
+			tx.Close()
+			return nil
+		}
+
+		tx.AbortTransaction()
+		if hasErrorLabel(err, labelTransientTransaction) && time.Now().Before(deadline) {
+			continue
+		}
+		return err
+	}
+}
+
+// sessionContext makes ctx join the transaction of c if there is one
+func (c *Connection) sessionContext(ctx context.Context) context.Context {
+	if c.session == nil || mongo.SessionFromContext(ctx) != nil {
+		return ctx
+	}
+	return mongo.NewSessionContext(ctx, c.session)
+}
+
+// endSession aborts the transaction of c if it is still open and ends its
+// session
+func (c *Connection) endSession() {
+	if c.session == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	if err := c.session.AbortTransaction(ctx); err != nil && !transactionEnded(err) {
+		dbflex.Logger().Warningf("unable to abort transaction. %s", err.Error())
+	}
+	c.session.EndSession(ctx)
+	c.session = nil
+	c.client = nil
+	c.release()
+}
+
+// labeledError is an error with the message of flexmgo that still unwraps
+// to the error of the driver, so the labels WithTransaction retries on are
+// not lost
+type labeledError struct {
+	msg string
+	err error
+}
+
+func (e *labeledError) Error() string { return e.msg }
+func (e *labeledError) Unwrap() error { return e.err }
+
+// wrapError is toolkit.Errorf keeping err as the cause
+func wrapError(err error, format string, args ...interface{}) error {
+	return &labeledError{fmt.Sprintf(format, args...), err}
+}
+
+// transactionEnded tells whether err is returned by an abort because the
+// transaction is already committed or aborted
+func transactionEnded(err error) bool {
+	return errors.Is(err, session.ErrAbortAfterCommit) || errors.Is(err, session.ErrAbortTwice) ||
+		errors.Is(err, session.ErrNoTransactStarted)
+}
+
+func hasErrorLabel(err error, label string) bool {
+	var se mongo.ServerError
+	if errors.As(err, &se) {
+		return se.HasErrorLabel(label)
+	}
+	return false
+}